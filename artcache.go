@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// defaultArticleNumberCacheSize is used when the article number cache is
+// enabled without an explicit size.
+const defaultArticleNumberCacheSize = 100000
+
+type articleKey struct {
+	backend string
+	group   string
+	number  string
+}
+
+type articleEntry struct {
+	key       articleKey
+	messageID string
+}
+
+// articleNumberCache maps (backend, group, article number) to message-id,
+// evicting the least recently used entry once full. Article numbers are
+// assigned by each backend, so entries are only valid for the backend that
+// reported them.
+type articleNumberCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[articleKey]*list.Element
+}
+
+var articleNumbers = &articleNumberCache{
+	order:   list.New(),
+	entries: make(map[articleKey]*list.Element),
+}
+
+func (c *articleNumberCache) add(backend, group, number, messageID string) {
+	if group == "" || !isArticleNumber(number) || number == "0" || !strings.HasPrefix(messageID, "<") {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := articleKey{backend, group, number}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*articleEntry).messageID = messageID
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&articleEntry{key, messageID})
+
+	size := c.size
+	if size <= 0 {
+		size = defaultArticleNumberCacheSize
+	}
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*articleEntry).key)
+	}
+}
+
+// lookup returns the message-id cached for an article number in group on
+// backend.
+func (c *articleNumberCache) lookup(backend, group, number string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[articleKey{backend, group, number}]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*articleEntry).messageID, true
+}
+
+func (c *articleNumberCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// observeResponse records the selected group and article numbers from a
+// response status line. For overview responses it returns a callback
+// collecting message-ids from the data lines.
+func (s *session) observeResponse(verb string, line string) func([]byte) {
+	fields := strings.Fields(line)
+
+	switch {
+	case (verb == "GROUP" || verb == "LISTGROUP") && responseCode(line) == 211 && len(fields) >= 5:
+		// 211 count low high group
+		s.group = fields[4]
+	case verb == "STAT" && responseCode(line) == 223 && len(fields) >= 3 && !strings.Contains(s.command, "<"):
+		// 223 number message-id, for a request by number
+		articleNumbers.add(s.selectedBackend.BackendName, s.group, fields[1], fields[2])
+	case (verb == "OVER" || verb == "XOVER") && responseCode(line) == 224:
+		backend, group := s.selectedBackend.BackendName, s.group
+		return func(data []byte) {
+			// number TAB subject TAB from TAB date TAB message-id TAB ...
+			cols := bytes.SplitN(bytes.TrimRight(data, "\r\n"), []byte("\t"), 6)
+			if len(cols) >= 5 {
+				articleNumbers.add(backend, group, string(cols[0]), string(cols[4]))
+			}
+		}
+	}
+	return nil
+}
+
+// isArticleNumber reports whether arg is an article number rather than a
+// message-id.
+func isArticleNumber(arg string) bool {
+	if arg == "" {
+		return false
+	}
+	for _, r := range arg {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// spooledByNumber returns the spool name for an ARTICLE or BODY request by
+// article number whose message-id is cached for the current group and
+// backend, together with the number. name is "" otherwise.
+func (s *session) spooledByNumber(verb string) (name string, number string) {
+	if !cfg.Frontend.FrontendArticleNumberCache || s.group == "" {
+		return "", ""
+	}
+	fields := strings.Fields(s.command)
+	if len(fields) != 2 || !isArticleNumber(fields[1]) {
+		return "", ""
+	}
+	messageID, ok := articleNumbers.lookup(s.selectedBackend.BackendName, s.group, fields[1])
+	if !ok {
+		return "", ""
+	}
+	return spoolName(verb, verb+" "+messageID), fields[1]
+}
+
+// syncCurrentArticle moves the backend to the article last answered from
+// the spool by number, since NEXT, LAST and commands without an argument
+// work on the backend's current article. Selecting a group resets the
+// current article anyway, so it is not synced for GROUP and LISTGROUP.
+func (s *session) syncCurrentArticle(verb string) error {
+	number := s.pendingArticle
+	s.pendingArticle = ""
+	if number == "" || verb == "GROUP" || verb == "LISTGROUP" {
+		return nil
+	}
+
+	err := s.backend.PrintfLine("STAT %s", number)
+	if err != nil {
+		return err
+	}
+	_, err = s.backend.ReadLine()
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is the security audit trail of logins and logouts. It is kept
+// separate from the operational log so it can be shipped and rotated on its
+// own.
+var (
+	auditLog   *os.File
+	auditLogMu sync.Mutex
+)
+
+func openAuditLog() error {
+	if cfg.Frontend.FrontendAuditLog == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(cfg.Frontend.FrontendAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	auditLog = f
+	return nil
+}
+
+// reopenAuditLog closes and reopens the audit log so external rotation can
+// move the old file away first. Writes wait on auditLogMu, so none are lost
+// while the file is swapped.
+func reopenAuditLog() {
+	err := openAuditLog()
+	if err != nil {
+		log.Printf("[AUDIT] Reopening %v failed: %v", cfg.Frontend.FrontendAuditLog, err)
+		return
+	}
+	log.Printf("[AUDIT] Reopened %v", cfg.Frontend.FrontendAuditLog)
+}
+
+// audit records the event in the audit log and on the event socket.
+func audit(event string, username string, ip string, detail string) {
+	emitEvent(event, username, ip, detail)
+
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+
+	if auditLog == nil {
+		return
+	}
+
+	line := fmt.Sprintf("%v %v user=%q ip=%v", time.Now().Format(time.RFC3339), event, username, ip)
+	if detail != "" {
+		line += " " + detail
+	}
+
+	_, err := fmt.Fprintln(auditLog, line)
+	if err != nil {
+		log.Printf("[AUDIT] Write failed: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultAuthorizerTimeout = 5 * time.Second
+
+// Authorizer checks the credentials of a client login. It returns the user
+// record whose limits, policy and connection group apply to the session, or
+// nil if it does not accept the credentials. An error means the authorizer
+// could not decide, and the next one in the chain is asked.
+type Authorizer interface {
+	Authorize(user string, password string, ip string) (*config.User, error)
+}
+
+// authorizers is the login chain, asked in order until one accepts.
+var authorizers []Authorizer
+
+// staticAuthorizer accepts the users of the configuration.
+type staticAuthorizer struct{}
+
+func (staticAuthorizer) Authorize(user string, password string, ip string) (*config.User, error) {
+	mu.Lock()
+	users := cfg.Users
+	mu.Unlock()
+
+	for _, elem := range users {
+		if elem.Username == user && verifyPassword(password, elem.Password) {
+			return &elem, nil
+		}
+	}
+	return nil, nil
+}
+
+// httpAuthorizer posts the credentials as JSON to an external service. The
+// service answers 200 with a user record, without password, to accept the
+// login, and 401 or 403 to reject it. A record naming a policy or connection
+// group that is not configured is not accepted, so a typo in the service
+// cannot lift the restrictions they would impose.
+type httpAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func (a httpAuthorizer) Authorize(user string, password string, ip string) (*config.User, error) {
+	body, err := json.Marshal(map[string]string{"username": user, "password": password, "ip": ip})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	var record config.User
+	err = json.NewDecoder(resp.Body).Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	record.Username = user
+	record.Password = ""
+
+	err = cfg.CheckUserPolicies([]config.User{record})
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// buildAuthorizers sets up the configured login chain, which defaults to
+// the static users alone.
+func buildAuthorizers(c config.Configuration) ([]Authorizer, error) {
+	if len(c.Frontend.FrontendAuthorizers) == 0 {
+		return []Authorizer{staticAuthorizer{}}, nil
+	}
+
+	chain := []Authorizer{}
+	for _, elem := range c.Frontend.FrontendAuthorizers {
+		switch elem.AuthorizerType {
+		case "static":
+			chain = append(chain, staticAuthorizer{})
+		case "http":
+			if elem.AuthorizerURL == "" {
+				return nil, fmt.Errorf("http authorizer needs authorizerURL")
+			}
+			timeout := defaultAuthorizerTimeout
+			if elem.AuthorizerTimeout > 0 {
+				timeout = time.Duration(elem.AuthorizerTimeout) * time.Second
+			}
+			chain = append(chain, httpAuthorizer{url: elem.AuthorizerURL, client: &http.Client{Timeout: timeout}})
+		default:
+			return nil, fmt.Errorf("unknown authorizer type %q", elem.AuthorizerType)
+		}
+	}
+	return chain, nil
+}
+
+// authorize asks the login chain in order and returns the user record of the
+// first authorizer accepting the credentials, or nil if none does.
+func authorize(user string, password string, ip string) *config.User {
+	for i, elem := range authorizers {
+		record, err := elem.Authorize(user, password, ip)
+		if err != nil {
+			log.Printf("[AUTH] Authorizer %v failed for %v: %v", i+1, user, err)
+			continue
+		}
+		if record != nil {
+			return record
+		}
+	}
+	return nil
+}
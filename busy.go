@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultBusyWindow = time.Minute
+
+var (
+	// recentConnects holds the connection times per client IP within the
+	// busy window.
+	recentConnects   = make(map[string][]time.Time)
+	recentConnectsMu sync.Mutex
+	lastConnectSweep time.Time
+)
+
+func busyWindow() time.Duration {
+	if cfg.Frontend.FrontendBusyWindow > 0 {
+		return time.Duration(cfg.Frontend.FrontendBusyWindow) * time.Second
+	}
+	return defaultBusyWindow
+}
+
+// recordConnect notes a connection from ip and returns how many connections
+// the ip opened within the busy window, including this one.
+func recordConnect(ip string) int {
+	recentConnectsMu.Lock()
+	defer recentConnectsMu.Unlock()
+
+	now := time.Now()
+	window := busyWindow()
+
+	// Forget clients that have been quiet for a whole window.
+	if now.Sub(lastConnectSweep) > window {
+		for key, times := range recentConnects {
+			if now.Sub(times[len(times)-1]) > window {
+				delete(recentConnects, key)
+			}
+		}
+		lastConnectSweep = now
+	}
+
+	times := recentConnects[ip]
+	for len(times) > 0 && now.Sub(times[0]) > window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	recentConnects[ip] = times
+	return len(times)
+}
+
+// backendUtilization returns the share of all backend slots in use.
+func backendUtilization() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+
+	used, total := 0, 0
+	for _, elem := range cfg.Backend {
+		used += backendConnections[elem.BackendName]
+		total += elem.BackendConns
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total)
+}
+
+// shouldSignalBusy reports whether a client reconnecting from ip should be
+// asked to back off: the backends are at least FrontendBusyUtilization full
+// and the ip reconnected more than FrontendBusyReconnects times within the
+// busy window.
+func shouldSignalBusy(ip string) bool {
+	if cfg.Frontend.FrontendBusyUtilization <= 0 || cfg.Frontend.FrontendBusyReconnects <= 0 {
+		return false
+	}
+
+	connects := recordConnect(ip)
+	return connects > cfg.Frontend.FrontendBusyReconnects && backendUtilization() >= cfg.Frontend.FrontendBusyUtilization
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"net"
+	"os"
+	"strings"
+)
+
+// certPoliciesEnabled reports whether client certificates are requested to
+// look up a policy for them.
+func certPoliciesEnabled() bool {
+	return len(cfg.Frontend.FrontendCertPolicies) > 0 || cfg.Frontend.FrontendDefaultCertPolicy != ""
+}
+
+// configureClientCerts makes the frontend ask for client certificates. With
+// FrontendClientCA they are verified against it, otherwise only their
+// fingerprint can be trusted.
+func configureClientCerts(tlsConf *tls.Config) error {
+	if cfg.Frontend.FrontendClientCA == "" {
+		tlsConf.ClientAuth = tls.RequestClientCert
+		return nil
+	}
+
+	bundle, err := os.ReadFile(cfg.Frontend.FrontendClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return errors.New("no certificates found in " + cfg.Frontend.FrontendClientCA)
+	}
+	tlsConf.ClientCAs = pool
+	tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// certPolicy returns the policy mapped to the client certificate of conn,
+// the default certificate policy for other certificates, or nil if the
+// client sent none.
+func certPolicy(conn net.Conn) *config.Policy {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.Handshake() != nil {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	verified := len(state.VerifiedChains) > 0
+
+	for _, elem := range cfg.Frontend.FrontendCertPolicies {
+		if elem.CertFingerprint != "" && strings.EqualFold(strings.ReplaceAll(elem.CertFingerprint, ":", ""), fingerprint) {
+			return cfg.FindPolicy(elem.CertPolicy)
+		}
+		if elem.CertCN != "" && verified && elem.CertCN == cert.Subject.CommonName {
+			return cfg.FindPolicy(elem.CertPolicy)
+		}
+	}
+	return cfg.FindPolicy(cfg.Frontend.FrontendDefaultCertPolicy)
+}
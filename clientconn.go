@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errClientStalled reports that the client stopped reading for longer than
+// FrontendWriteTimeout.
+var errClientStalled = errors.New("client stopped reading")
+
+// throttleSlack is how far the download rate limit may catch up on time lost
+// to scheduling.
+const throttleSlack = 50 * time.Millisecond
+
+// clientWriter renews the write deadline of the client connection before
+// every write, so a client that stops draining responses is cut off after
+// FrontendWriteTimeout instead of holding the backend connection forever.
+// It also paces writes to the session's download rate limit.
+type clientWriter struct {
+	net.Conn
+	timeout atomic.Int64
+	rate    atomic.Int64
+
+	// next is when the bytes written so far are due at the rate limit.
+	next time.Time
+}
+
+func newClientWriter(conn net.Conn) *clientWriter {
+	w := &clientWriter{Conn: conn}
+	w.timeout.Store(int64(time.Duration(cfg.Frontend.FrontendWriteTimeout) * time.Second))
+	w.rate.Store(cfg.Frontend.FrontendMaxBytesPerSec)
+	return w
+}
+
+func (w *clientWriter) Write(b []byte) (int, error) {
+	w.throttle(len(b))
+
+	timeout := time.Duration(w.timeout.Load())
+	if timeout > 0 {
+		w.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	n, err := w.Conn.Write(b)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && timeout > 0 {
+		return n, errClientStalled
+	}
+	return n, err
+}
+
+// throttle waits until the previous writes are due at the rate limit and
+// then accounts for n more bytes. Time the client spent idle is only credited
+// up to throttleSlack, which absorbs oversleeping without allowing bursts.
+func (w *clientWriter) throttle(n int) {
+	rate := w.rate.Load()
+	if rate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if w.next.Before(now.Add(-throttleSlack)) {
+		w.next = now.Add(-throttleSlack)
+	}
+	time.Sleep(w.next.Sub(now))
+	w.next = w.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+}
+
+// setRate changes the download rate limit in bytes per second; 0 disables
+// it.
+func (w *clientWriter) setRate(bytesPerSec int64) {
+	w.rate.Store(bytesPerSec)
+}
+
+// stop leaves the write deadline to the caller from now on.
+func (w *clientWriter) stop() {
+	w.timeout.Store(0)
+}
+
+// setNoDelay switches TCP_NODELAY of the client connection, below TLS if
+// the client is encrypted.
+func (w *clientWriter) setNoDelay(noDelay bool) {
+	conn := w.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(noDelay)
+	}
+}
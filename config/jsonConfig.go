@@ -6,49 +6,561 @@
 
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
 type Configuration struct {
-	Frontend frontendConfig
-	Backend  []backendConfig
-	Users    []user
+	Frontend         frontendConfig
+	Backend          []BackendConfig
+	Users            []User
+	Policies         []Policy
+	ConnectionGroups []ConnectionGroup
 	SelectedBackend
 }
 
 type frontendConfig struct {
-	FrontendAddr            string             `json:"frontendAddr"`
-	FrontendPort            string             `json:"frontendPort"`
-	FrontendTLS             bool               `json:"frontendTLS"`
-	FrontendTLSCert         string             `json:"frontendTLSCert"`
-	FrontendTLSKey          string             `json:"frontendTLSKey"`
-	FrontendHTTPAddr        string             `json:"frontendHTTPAddr"`
-	FrontendHTTPPort        string             `json:"frontendHTTPPort"`
-	FrontendAllowedCommands []frontendCommands `json:"frontendAllowedCommands"`
+	FrontendAddr                           string              `json:"frontendAddr"`
+	FrontendPort                           string              `json:"frontendPort"`
+	FrontendTLS                            bool                `json:"frontendTLS"`
+	FrontendTLSCert                        string              `json:"frontendTLSCert"`
+	FrontendTLSKey                         string              `json:"frontendTLSKey"`
+	FrontendTLSStrictStartup               bool                `json:"frontendTLSStrictStartup"`
+	FrontendTLSCABundle                    string              `json:"frontendTLSCABundle"`
+	FrontendLogClientFingerprint           bool                `json:"frontendLogClientFingerprint"`
+	FrontendClientCA                       string              `json:"frontendClientCA"`
+	FrontendCertPolicies                   []CertPolicy        `json:"frontendCertPolicies"`
+	FrontendDefaultCertPolicy              string              `json:"frontendDefaultCertPolicy"`
+	FrontendAuthorizers                    []AuthorizerConfig  `json:"frontendAuthorizers"`
+	FrontendHTTPAddr                       string              `json:"frontendHTTPAddr"`
+	FrontendHTTPPort                       string              `json:"frontendHTTPPort"`
+	FrontendHTTPUser                       string              `json:"frontendHTTPUser"`
+	FrontendHTTPPass                       string              `json:"frontendHTTPPass"`
+	FrontendHTTPTrustedProxies             []string            `json:"frontendHTTPTrustedProxies"`
+	FrontendAllowedCIDRs                   []string            `json:"frontendAllowedCIDRs"`
+	FrontendDeniedCIDRs                    []string            `json:"frontendDeniedCIDRs"`
+	FrontendMaxConnsPerIP                  int                 `json:"frontendMaxConnsPerIP"`
+	FrontendMaxConnections                 int                 `json:"frontendMaxConnections"`
+	FrontendSpoolDir                       string              `json:"frontendSpoolDir"`
+	FrontendSpoolMaxBytes                  int64               `json:"frontendSpoolMaxBytes"`
+	FrontendSpoolMaxArticleBytes           int64               `json:"frontendSpoolMaxArticleBytes"`
+	FrontendMaxBufferedResponseBytes       int64               `json:"frontendMaxBufferedResponseBytes"`
+	FrontendAllowedCommands                []frontendCommands  `json:"frontendAllowedCommands"`
+	FrontendStrictAllowedCommands          bool                `json:"frontendStrictAllowedCommands"`
+	FrontendUnknownCommandResponse         string              `json:"frontendUnknownCommandResponse"`
+	FrontendDisallowedCommandResponse      string              `json:"frontendDisallowedCommandResponse"`
+	FrontendAllowBackendHint               bool                `json:"frontendAllowBackendHint"`
+	FrontendBackendStrategy                string              `json:"frontendBackendStrategy"`
+	FrontendRequireSecureAuth              bool                `json:"frontendRequireSecureAuth"`
+	FrontendMaintenanceFile                string              `json:"frontendMaintenanceFile"`
+	FrontendMaintenanceWindows             []MaintenanceWindow `json:"frontendMaintenanceWindows"`
+	FrontendMaintenanceMessage             string              `json:"frontendMaintenanceMessage"`
+	FrontendWelcomeMessage                 string              `json:"frontendWelcomeMessage"`
+	FrontendMOTDFile                       string              `json:"frontendMOTDFile"`
+	FrontendArticleNumberCache             bool                `json:"frontendArticleNumberCache"`
+	FrontendArticleNumberCacheSize         int                 `json:"frontendArticleNumberCacheSize"`
+	FrontendWaitForBackend                 bool                `json:"frontendWaitForBackend"`
+	FrontendHealthCheckInterval            int                 `json:"frontendHealthCheckInterval"`
+	FrontendAllowStreaming                 bool                `json:"frontendAllowStreaming"`
+	FrontendKeepaliveCommand               string              `json:"frontendKeepaliveCommand"`
+	FrontendMaxListLines                   int                 `json:"frontendMaxListLines"`
+	FrontendUsersFile                      string              `json:"frontendUsersFile"`
+	FrontendQuotaStateFile                 string              `json:"frontendQuotaStateFile"`
+	FrontendUserQuotaStateFile             string              `json:"frontendUserQuotaStateFile"`
+	FrontendUserQuotaResetCron             string              `json:"frontendUserQuotaResetCron"`
+	FrontendAuditLog                       string              `json:"frontendAuditLog"`
+	FrontendEventSocket                    string              `json:"frontendEventSocket"`
+	FrontendStrictConfigPerms              bool                `json:"frontendStrictConfigPerms"`
+	FrontendMaxConcurrentAuth              int                 `json:"frontendMaxConcurrentAuth"`
+	FrontendCloseDrainTimeout              int                 `json:"frontendCloseDrainTimeout"`
+	FrontendIdleTimeout                    int                 `json:"frontendIdleTimeout"`
+	FrontendWriteTimeout                   int                 `json:"frontendWriteTimeout"`
+	FrontendAdaptiveNoDelay                bool                `json:"frontendAdaptiveNoDelay"`
+	FrontendMaxBytesPerSec                 int64               `json:"frontendMaxBytesPerSec"`
+	FrontendMaxSessionDuration             int                 `json:"frontendMaxSessionDuration"`
+	FrontendPerCommandBackend              bool                `json:"frontendPerCommandBackend"`
+	FrontendPoolSessions                   bool                `json:"frontendPoolSessions"`
+	FrontendMaxConcurrentFetchesPerSession int                 `json:"frontendMaxConcurrentFetchesPerSession"`
+	FrontendMaxGroupSwitches               int                 `json:"frontendMaxGroupSwitches"`
+	FrontendLogSampleRate                  float64             `json:"frontendLogSampleRate"`
+	FrontendDebug                          bool                `json:"frontendDebug"`
+	FrontendPreAuthLingerDelay             int                 `json:"frontendPreAuthLingerDelay"`
+	FrontendBusyUtilization                float64             `json:"frontendBusyUtilization"`
+	FrontendBusyReconnects                 int                 `json:"frontendBusyReconnects"`
+	FrontendBusyWindow                     int                 `json:"frontendBusyWindow"`
+	FrontendBusyMessage                    string              `json:"frontendBusyMessage"`
+	FrontendMaxDistinctIPsPerUser          int                 `json:"frontendMaxDistinctIPsPerUser"`
+	FrontendEnforceDistinctIPs             bool                `json:"frontendEnforceDistinctIPs"`
+	FrontendUserConnQueueTimeout           int                 `json:"frontendUserConnQueueTimeout"`
+	FrontendListeners                      []listenerConfig    `json:"frontendListeners"`
+}
+
+// listenerConfig is an additional frontend listener whose sessions only use
+// the backends of ListenerBackendGroup.
+type listenerConfig struct {
+	ListenerAddr         string `json:"listenerAddr"`
+	ListenerPort         string `json:"listenerPort"`
+	ListenerBackendGroup string `json:"listenerBackendGroup"`
 }
 
 type frontendCommands struct {
 	FrontendCommand string `json:"frontendCommand"`
 }
 
-type backendConfig struct {
-	BackendName  string `json:"backendName"`
-	BackendAddr  string `json:"backendAddr"`
-	BackendPort  string `json:"backendPort"`
-	BackendTLS   bool   `json:"backendTLS"`
-	BackendUser  string `json:"backendUser"`
-	BackendPass  string `json:"backendPass"`
-	BackendConns int    `json:"backendConns"`
+// BackendConfig is one entry of the Backend list.
+type BackendConfig struct {
+	BackendName                   string            `json:"backendName"`
+	BackendAddr                   string            `json:"backendAddr"`
+	BackendPort                   string            `json:"backendPort"`
+	BackendTLS                    bool              `json:"backendTLS"`
+	BackendStartTLS               bool              `json:"backendStartTLS"`
+	BackendServerName             string            `json:"backendServerName"`
+	BackendInsecureSkipVerify     bool              `json:"backendInsecureSkipVerify"`
+	BackendPinnedCertSHA256       string            `json:"backendPinnedCertSHA256"`
+	BackendUser                   string            `json:"backendUser"`
+	BackendPass                   string            `json:"backendPass"`
+	BackendConns                  int               `json:"backendConns"`
+	BackendWeight                 int               `json:"backendWeight"`
+	BackendPriority               int               `json:"backendPriority"`
+	BackendMaxConcurrentDials     int               `json:"backendMaxConcurrentDials"`
+	BackendForwardClientIPCommand string            `json:"backendForwardClientIPCommand"`
+	BackendCompress               bool              `json:"backendCompress"`
+	BackendCredentials            []Credential      `json:"backendCredentials"`
+	BackendCredentialSource       string            `json:"backendCredentialSource"`
+	BackendCredentialInterval     int               `json:"backendCredentialInterval"`
+	BackendUnhealthyThreshold     int               `json:"backendUnhealthyThreshold"`
+	BackendHealthyThreshold       int               `json:"backendHealthyThreshold"`
+	BackendFailurePenaltyDuration int               `json:"backendFailurePenaltyDuration"`
+	BackendQuotaBytes             int64             `json:"backendQuotaBytes"`
+	BackendQuotaResetCron         string            `json:"backendQuotaResetCron"`
+	BackendGroup                  string            `json:"backendGroup"`
+	BackendResponseMap            []ResponseMapping `json:"backendResponseMap"`
+	BackendIdleProbeCommand       string            `json:"backendIdleProbeCommand"`
+	BackendIdleProbeInterval      int               `json:"backendIdleProbeInterval"`
+	BackendRequireModeReader      bool              `json:"backendRequireModeReader"`
+	BackendAutoModeReader         bool              `json:"backendAutoModeReader"`
+	BackendConnLeaseTTL           int               `json:"backendConnLeaseTTL"`
+	BackendMaxResponseTime        int               `json:"backendMaxResponseTime"`
+}
+
+// Credential is one account on a backend. CredentialMaxConns limits the
+// connections logged in with it; 0 means only the backend limit applies.
+type Credential struct {
+	CredentialUser     string `json:"credentialUser"`
+	CredentialPass     string `json:"credentialPass"`
+	CredentialMaxConns int    `json:"credentialMaxConns"`
+}
+
+// ResponseMapping translates a backend response code to another one. With
+// MappingMatch set, only responses whose text contains it are translated.
+type ResponseMapping struct {
+	MappingFrom  int    `json:"mappingFrom"`
+	MappingMatch string `json:"mappingMatch"`
+	MappingTo    int    `json:"mappingTo"`
+}
+
+// Credentials returns the accounts configured for the backend. Without
+// BackendCredentials the BackendUser/BackendPass pair is the only one.
+func (b BackendConfig) Credentials() []Credential {
+	if len(b.BackendCredentials) > 0 {
+		return b.BackendCredentials
+	}
+	return []Credential{{CredentialUser: b.BackendUser, CredentialPass: b.BackendPass}}
+}
+
+// Selected returns the connection details of the backend.
+func (b BackendConfig) Selected() *SelectedBackend {
+	return &SelectedBackend{
+		BackendName:                   b.BackendName,
+		BackendAddr:                   b.BackendAddr,
+		BackendPort:                   b.BackendPort,
+		BackendTLS:                    b.BackendTLS,
+		BackendStartTLS:               b.BackendStartTLS,
+		BackendServerName:             b.BackendServerName,
+		BackendInsecureSkipVerify:     b.BackendInsecureSkipVerify,
+		BackendPinnedCertSHA256:       b.BackendPinnedCertSHA256,
+		BackendUser:                   b.BackendUser,
+		BackendPass:                   b.BackendPass,
+		BackendForwardClientIPCommand: b.BackendForwardClientIPCommand,
+		BackendCompress:               b.BackendCompress,
+		BackendResponseMap:            b.BackendResponseMap,
+		BackendRequireModeReader:      b.BackendRequireModeReader,
+		BackendAutoModeReader:         b.BackendAutoModeReader,
+		BackendConnLeaseTTL:           b.BackendConnLeaseTTL,
+		BackendMaxResponseTime:        b.BackendMaxResponseTime,
+	}
+}
+
+// User is a client account and the limits that apply to its sessions.
+type User struct {
+	Username              string   `json:"Username"`
+	Password              string   `json:"Password"`
+	MaxConnections        int      `json:"maxConnections"`
+	MaxCommandsPerSec     float64  `json:"maxCommandsPerSec"`
+	MaxCommandBurst       float64  `json:"maxCommandBurst"`
+	MaxConcurrentCommands int      `json:"maxConcurrentCommands"`
+	MaxReadConnections    int      `json:"maxReadConnections"`
+	MaxPostConnections    int      `json:"maxPostConnections"`
+	MaxBytes              int64    `json:"maxBytes"`
+	MaxBytesPerSec        int64    `json:"maxBytesPerSec"`
+	ConnectionGroup       string   `json:"connectionGroup"`
+	AllowedIPs            []string `json:"allowedIPs"`
+	Policy                string   `json:"policy"`
+}
+
+// Policy is a named set of restrictions shared by the users referencing it.
+type Policy struct {
+	PolicyName            string   `json:"policyName"`
+	PolicyAllowedCommands []string `json:"policyAllowedCommands"`
+	PolicyAllowedGroups   []string `json:"policyAllowedGroups"`
+	PolicyAllowedBackends []string `json:"policyAllowedBackends"`
+	PolicyMaxConnections  int      `json:"policyMaxConnections"`
+}
+
+// CertPolicy assigns a policy to TLS clients presenting a certificate with
+// the given SHA-256 fingerprint or, when client certificates are verified,
+// common name.
+type CertPolicy struct {
+	CertFingerprint string `json:"certFingerprint"`
+	CertCN          string `json:"certCN"`
+	CertPolicy      string `json:"certPolicy"`
+}
+
+// MaintenanceWindow is a recurring period in which new logins are refused.
+// It starts whenever WindowStart, a cron expression evaluated in
+// WindowTimezone, matches and lasts WindowDuration seconds.
+type MaintenanceWindow struct {
+	WindowName     string `json:"windowName"`
+	WindowStart    string `json:"windowStart"`
+	WindowDuration int    `json:"windowDuration"`
+	WindowTimezone string `json:"windowTimezone"`
+}
+
+// AuthorizerConfig is one step of the login chain. AuthorizerType is
+// "static" for the configured users or "http" for an external service at
+// AuthorizerURL.
+type AuthorizerConfig struct {
+	AuthorizerType    string `json:"authorizerType"`
+	AuthorizerURL     string `json:"authorizerURL"`
+	AuthorizerTimeout int    `json:"authorizerTimeout"`
+}
+
+// ConnectionGroup is a connection limit shared by all users referencing it.
+type ConnectionGroup struct {
+	GroupName           string `json:"groupName"`
+	GroupMaxConnections int    `json:"groupMaxConnections"`
+}
+
+// AllowsCommand reports whether the policy permits the command verb. An
+// empty command list permits every command.
+func (p *Policy) AllowsCommand(verb string) bool {
+	if len(p.PolicyAllowedCommands) == 0 {
+		return true
+	}
+	for _, elem := range p.PolicyAllowedCommands {
+		if strings.EqualFold(elem, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGroup reports whether the policy permits selecting group. Patterns
+// use shell glob syntax; an empty list permits every group.
+func (p *Policy) AllowsGroup(group string) bool {
+	if len(p.PolicyAllowedGroups) == 0 {
+		return true
+	}
+	for _, elem := range p.PolicyAllowedGroups {
+		if ok, _ := path.Match(elem, group); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsBackend reports whether the policy permits sessions on the backend.
+// An empty backend list permits every backend.
+func (p *Policy) AllowsBackend(backendName string) bool {
+	if p == nil || len(p.PolicyAllowedBackends) == 0 {
+		return true
+	}
+	for _, elem := range p.PolicyAllowedBackends {
+		if elem == backendName {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCertPolicies verifies that every policy referenced for client
+// certificates exists, and that common names are only matched on verified
+// certificates.
+func (c *Configuration) CheckCertPolicies() error {
+	if c.Frontend.FrontendDefaultCertPolicy != "" && c.FindPolicy(c.Frontend.FrontendDefaultCertPolicy) == nil {
+		return fmt.Errorf("unknown default certificate policy %q", c.Frontend.FrontendDefaultCertPolicy)
+	}
+	for _, elem := range c.Frontend.FrontendCertPolicies {
+		if c.FindPolicy(elem.CertPolicy) == nil {
+			return fmt.Errorf("certificate %v%v: unknown policy %q", elem.CertFingerprint, elem.CertCN, elem.CertPolicy)
+		}
+		if elem.CertCN != "" && c.Frontend.FrontendClientCA == "" {
+			return fmt.Errorf("certificate %v: matching by common name requires frontendClientCA", elem.CertCN)
+		}
+	}
+	return nil
 }
 
-type user struct {
-	Username string `json:"Username"`
-	Password string `json:"Password"`
-	MaxConnections int `json:"maxConnections"`
+// FindPolicy returns the policy called name, or nil.
+func (c *Configuration) FindPolicy(name string) *Policy {
+	for i := range c.Policies {
+		if c.Policies[i].PolicyName == name {
+			return &c.Policies[i]
+		}
+	}
+	return nil
+}
+
+// FindConnectionGroup returns the connection group called name, or nil.
+func (c *Configuration) FindConnectionGroup(name string) *ConnectionGroup {
+	for i := range c.ConnectionGroups {
+		if c.ConnectionGroups[i].GroupName == name {
+			return &c.ConnectionGroups[i]
+		}
+	}
+	return nil
+}
+
+// UserMaxConnections returns the connection limit of u, falling back to
+// the limit of its policy when the user sets none.
+func (c *Configuration) UserMaxConnections(u User) int {
+	if u.MaxConnections == 0 {
+		if policy := c.FindPolicy(u.Policy); policy != nil {
+			return policy.PolicyMaxConnections
+		}
+	}
+	return u.MaxConnections
+}
+
+// CheckUserPolicies verifies that every policy and connection group
+// referenced by users exists.
+func (c *Configuration) CheckUserPolicies(users []User) error {
+	for _, elem := range users {
+		if elem.Policy != "" && c.FindPolicy(elem.Policy) == nil {
+			return fmt.Errorf("user %q: unknown policy %q", elem.Username, elem.Policy)
+		}
+		if elem.ConnectionGroup != "" && c.FindConnectionGroup(elem.ConnectionGroup) == nil {
+			return fmt.Errorf("user %q: unknown connection group %q", elem.Username, elem.ConnectionGroup)
+		}
+	}
+	return nil
+}
+
+// CheckListenerGroups verifies that every backend group referenced by a
+// listener contains at least one backend.
+func (c *Configuration) CheckListenerGroups() error {
+	for _, elem := range c.Frontend.FrontendListeners {
+		if elem.ListenerBackendGroup == "" {
+			continue
+		}
+		found := false
+		for _, backend := range c.Backend {
+			if backend.BackendGroup == elem.ListenerBackendGroup {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("listener %v:%v: unknown backend group %q", elem.ListenerAddr, elem.ListenerPort, elem.ListenerBackendGroup)
+		}
+	}
+	return nil
+}
+
+// ClientNetworks parses the frontend allow and deny lists of client
+// networks.
+func (c *Configuration) ClientNetworks() (allowed []*net.IPNet, denied []*net.IPNet, err error) {
+	for _, elem := range c.Frontend.FrontendAllowedCIDRs {
+		_, network, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, nil, fmt.Errorf("frontendAllowedCIDRs: %v", err)
+		}
+		allowed = append(allowed, network)
+	}
+	for _, elem := range c.Frontend.FrontendDeniedCIDRs {
+		_, network, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, nil, fmt.Errorf("frontendDeniedCIDRs: %v", err)
+		}
+		denied = append(denied, network)
+	}
+	return allowed, denied, nil
+}
+
+// knownCommands are the NNTP verbs of RFC 3977 and its extensions, plus the
+// common non-standard ones.
+var knownCommands = map[string]bool{
+	"ARTICLE": true, "AUTHINFO": true, "BODY": true, "CAPABILITIES": true,
+	"CHECK": true, "DATE": true, "GROUP": true, "HDR": true, "HEAD": true,
+	"HELP": true, "IHAVE": true, "LAST": true, "LIST": true,
+	"LISTGROUP": true, "MODE": true, "NEWGROUPS": true, "NEWNEWS": true,
+	"NEXT": true, "OVER": true, "POST": true, "QUIT": true, "STARTTLS": true,
+	"STAT": true, "TAKETHIS": true, "XFEATURE": true, "XGTITLE": true,
+	"XHDR": true, "XOVER": true, "XPAT": true, "XZVER": true,
+}
+
+// IsKnownCommand reports whether verb is a known NNTP command.
+func IsKnownCommand(verb string) bool {
+	return knownCommands[strings.ToUpper(verb)]
+}
+
+// UnknownAllowedCommands returns the allowed commands that are not known
+// NNTP verbs, which usually are typos.
+func (c *Configuration) UnknownAllowedCommands() []string {
+	unknown := []string{}
+	for _, elem := range c.Frontend.FrontendAllowedCommands {
+		if !knownCommands[strings.ToUpper(elem.FrontendCommand)] {
+			unknown = append(unknown, elem.FrontendCommand)
+		}
+	}
+	return unknown
 }
 
 type SelectedBackend struct {
-	BackendName string
-	BackendAddr string
-	BackendPort string
-	BackendTLS  bool
-	BackendUser string
-	BackendPass string
+	BackendName                   string
+	BackendAddr                   string
+	BackendPort                   string
+	BackendTLS                    bool
+	BackendStartTLS               bool
+	BackendServerName             string
+	BackendInsecureSkipVerify     bool
+	BackendPinnedCertSHA256       string
+	BackendUser                   string
+	BackendPass                   string
+	BackendForwardClientIPCommand string
+	BackendCompress               bool
+	BackendResponseMap            []ResponseMapping
+	BackendRequireModeReader      bool
+	BackendAutoModeReader         bool
+	BackendConnLeaseTTL           int
+	BackendMaxResponseTime        int
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the configuration with all passwords replaced,
+// along with the parts of credential sources and authorizer URLs that may
+// carry tokens.
+func (c Configuration) Redacted() Configuration {
+	if c.Frontend.FrontendHTTPPass != "" {
+		c.Frontend.FrontendHTTPPass = redacted
+	}
+	authorizers := make([]AuthorizerConfig, len(c.Frontend.FrontendAuthorizers))
+	for i, elem := range c.Frontend.FrontendAuthorizers {
+		elem.AuthorizerURL = redactURL(elem.AuthorizerURL)
+		authorizers[i] = elem
+	}
+	if c.Frontend.FrontendAuthorizers != nil {
+		c.Frontend.FrontendAuthorizers = authorizers
+	}
+	if c.BackendPass != "" {
+		c.BackendPass = redacted
+	}
+
+	backends := make([]BackendConfig, len(c.Backend))
+	for i, elem := range c.Backend {
+		if elem.BackendPass != "" {
+			elem.BackendPass = redacted
+		}
+		elem.BackendCredentialSource = redactSource(elem.BackendCredentialSource)
+		credentials := make([]Credential, len(elem.BackendCredentials))
+		for j, cred := range elem.BackendCredentials {
+			cred.CredentialPass = redacted
+			credentials[j] = cred
+		}
+		if elem.BackendCredentials != nil {
+			elem.BackendCredentials = credentials
+		}
+		backends[i] = elem
+	}
+	c.Backend = backends
+
+	users := make([]User, len(c.Users))
+	for i, elem := range c.Users {
+		elem.Password = redacted
+		users[i] = elem
+	}
+	c.Users = users
+
+	return c
+}
+
+// redactSource hides the arguments of an "exec:" credential source, or the
+// secrets in the URL of any other one.
+func redactSource(source string) string {
+	command, ok := strings.CutPrefix(source, "exec:")
+	if !ok {
+		return redactURL(source)
+	}
+	fields := strings.Fields(command)
+	if len(fields) <= 1 {
+		return source
+	}
+	return "exec:" + fields[0] + " " + redacted
+}
+
+// redactURL replaces the user info and the query parameter values of rawURL.
+// A URL that does not parse is replaced as a whole.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redacted}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// LoadUsers reads a JSON array of users from path and validates it, so a
+// broken file never replaces a working user list.
+func LoadUsers(path string) ([]User, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = json.Unmarshal(file, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i, elem := range users {
+		if elem.Username == "" || elem.Password == "" {
+			return nil, fmt.Errorf("user %d: username and password are required", i)
+		}
+		if seen[elem.Username] {
+			return nil, fmt.Errorf("user %q: duplicate username", elem.Username)
+		}
+		seen[elem.Username] = true
+	}
+
+	return users, nil
 }
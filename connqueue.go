@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// userConnFreed is signalled whenever a user connection is released.
+var userConnFreed = sync.NewCond(&mu)
+
+// waitUserConnLocked reports whether the user is below limit, waiting up to
+// FrontendUserConnQueueTimeout seconds for one of the user's connections to
+// be released. Must be called with mu held.
+func waitUserConnLocked(user string, limit int) bool {
+	if userConnections[user] < limit {
+		return true
+	}
+	if cfg.Frontend.FrontendUserConnQueueTimeout <= 0 {
+		return false
+	}
+
+	expired := false
+	timer := time.AfterFunc(time.Duration(cfg.Frontend.FrontendUserConnQueueTimeout)*time.Second, func() {
+		mu.Lock()
+		expired = true
+		mu.Unlock()
+		userConnFreed.Broadcast()
+	})
+	defer timer.Stop()
+
+	for userConnections[user] >= limit && !expired {
+		userConnFreed.Wait()
+	}
+	return userConnections[user] < limit
+}
+
+// releaseUserConnLocked releases a connection of the user and wakes logins
+// queued for a free slot. The rate limiter of the user goes with the last
+// connection. Must be called with mu held.
+func releaseUserConnLocked(user string) {
+	userConnections[user]--
+	if userConnections[user] <= 0 {
+		delete(userConnections, user)
+		dropUserCommandLimiter(user)
+	}
+	userConnFreed.Broadcast()
+}
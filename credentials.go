@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync/atomic"
+)
+
+// credentialConnections counts open connections per backend credential,
+// keyed by credentialKey. Guarded by mu.
+var credentialConnections = make(map[string]int)
+
+func credentialKey(backendName string, user string) string {
+	return backendName + "/" + user
+}
+
+func credentialBytesUsed(key string) int64 {
+	counter, ok := credentialBytes.Load(key)
+	if !ok {
+		return 0
+	}
+	return counter.(*atomic.Int64).Load()
+}
+
+// pickCredential chooses the credential that has transferred the fewest
+// bytes, breaking ties by open connections. Credentials at their
+// CredentialMaxConns are skipped; ok is false if all of them are. Must be
+// called with mu held.
+func pickCredential(backendName string, credentials []config.Credential) (best config.Credential, ok bool) {
+	bestKey := ""
+	for _, elem := range credentials {
+		key := credentialKey(backendName, elem.CredentialUser)
+		if elem.CredentialMaxConns > 0 && credentialConnections[key] >= elem.CredentialMaxConns {
+			continue
+		}
+		if !ok {
+			best, bestKey, ok = elem, key, true
+			continue
+		}
+		used, bestUsed := credentialBytesUsed(key), credentialBytesUsed(bestKey)
+		if used < bestUsed || (used == bestUsed && credentialConnections[key] < credentialConnections[bestKey]) {
+			best, bestKey = elem, key
+		}
+	}
+	return best, ok
+}
+
+// backendHasRoomLocked reports whether a new connection to the backend at
+// index i of cfg.Backend fits both its slots and a credential. Must be called
+// with mu held.
+func backendHasRoomLocked(i int) bool {
+	elem := cfg.Backend[i]
+	if backendConnections[elem.BackendName] >= elem.BackendConns {
+		return false
+	}
+	_, ok := pickCredential(elem.BackendName, elem.Credentials())
+	return ok
+}
+
+// releaseBackendLocked returns the backend and credential slots held by
+// selectedBackend. Must be called with mu held.
+func releaseBackendLocked(selectedBackend *config.SelectedBackend) {
+	backendConnections[selectedBackend.BackendName] -= 1
+	credentialConnections[credentialKey(selectedBackend.BackendName, selectedBackend.BackendUser)] -= 1
+}
+
+// writeCredentialUsage renders connections and bytes per backend credential.
+func writeCredentialUsage(w io.Writer) {
+	var buf bytes.Buffer
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		if len(elem.BackendCredentials) == 0 {
+			continue
+		}
+		for _, cred := range elem.Credentials() {
+			key := credentialKey(elem.BackendName, cred.CredentialUser)
+			if cred.CredentialMaxConns > 0 {
+				fmt.Fprintf(&buf, "%v - %v / %v connections / %v bytes\n", key, credentialConnections[key], cred.CredentialMaxConns, credentialBytesUsed(key))
+			} else {
+				fmt.Fprintf(&buf, "%v - %v connections / %v bytes\n", key, credentialConnections[key], credentialBytesUsed(key))
+			}
+		}
+	}
+	mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// reloadBackendCredentials reads the backend credentials from the config
+// file again. Only connections established afterwards use them; connections
+// already logged in with the old credentials stay open until they close.
+func reloadBackendCredentials() {
+	file, err := os.ReadFile(configPath)
+	if err != nil {
+		log.Printf("[CREDENTIALS] Reload of %v failed, keeping current credentials: %v", configPath, err)
+		return
+	}
+
+	var reloaded config.Configuration
+	err = json.Unmarshal(file, &reloaded)
+	if err != nil {
+		log.Printf("[CREDENTIALS] Reload of %v failed, keeping current credentials: %v", configPath, err)
+		return
+	}
+
+	updateBackends(func(backends []config.BackendConfig) {
+		for i, elem := range backends {
+			for _, update := range reloaded.Backend {
+				// Credentials from a credential source are not in the file.
+				if update.BackendName != elem.BackendName || elem.BackendCredentialSource != "" {
+					continue
+				}
+				if update.BackendUser == elem.BackendUser && update.BackendPass == elem.BackendPass && reflect.DeepEqual(update.BackendCredentials, elem.BackendCredentials) {
+					continue
+				}
+				backends[i].BackendUser = update.BackendUser
+				backends[i].BackendPass = update.BackendPass
+				backends[i].BackendCredentials = update.BackendCredentials
+				log.Printf("[CREDENTIALS] Backend %v credentials changed, used for new connections", elem.BackendName)
+			}
+		}
+	})
+}
+
+// backendsSnapshot returns the current backend list for use without holding
+// mu. The list is only ever replaced as a whole by updateBackends, never
+// changed in place, so the snapshot stays consistent.
+func backendsSnapshot() []config.BackendConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	return cfg.Backend
+}
+
+// updateBackends lets update change a copy of the backend list and then
+// publishes the copy. update is called with mu held.
+func updateBackends(update func(backends []config.BackendConfig)) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	backends := append(cfg.Backend[:0:0], cfg.Backend...)
+	update(backends)
+	cfg.Backend = backends
+}
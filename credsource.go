@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCredentialInterval = 5 * time.Minute
+	credentialFetchTimeout    = 30 * time.Second
+)
+
+// A backend with backendCredentialSource fetches its credentials from an
+// external source every backendCredentialInterval seconds. The source is
+// either an http(s) URL or "exec:" followed by a command line, and yields
+// a JSON credential object or an array of them. As with a reload, only
+// connections established afterwards use new credentials.
+
+// startCredentialSources fetches the credentials of every backend with a
+// credential source once, then keeps them current in the background.
+func startCredentialSources() {
+	for _, elem := range backendsSnapshot() {
+		if elem.BackendCredentialSource == "" {
+			continue
+		}
+
+		interval := defaultCredentialInterval
+		if elem.BackendCredentialInterval > 0 {
+			interval = time.Duration(elem.BackendCredentialInterval) * time.Second
+		}
+
+		rotateCredentials(elem.BackendName, elem.BackendCredentialSource)
+		go func(backendName string, source string) {
+			for range time.Tick(interval) {
+				rotateCredentials(backendName, source)
+			}
+		}(elem.BackendName, elem.BackendCredentialSource)
+	}
+}
+
+// rotateCredentials fetches the credentials of the backend from source and
+// uses them for new connections if they changed.
+func rotateCredentials(backendName string, source string) {
+	credentials, err := fetchCredentials(source)
+	if err != nil {
+		log.Printf("[CREDENTIALS] Fetching credentials of backend %v failed, keeping current ones: %v", backendName, err)
+		return
+	}
+
+	updateBackends(func(backends []config.BackendConfig) {
+		for i, elem := range backends {
+			if elem.BackendName != backendName || reflect.DeepEqual(elem.Credentials(), credentials) {
+				continue
+			}
+			if len(credentials) == 1 {
+				backends[i].BackendUser = credentials[0].CredentialUser
+				backends[i].BackendPass = credentials[0].CredentialPass
+				backends[i].BackendCredentials = nil
+			} else {
+				backends[i].BackendCredentials = credentials
+			}
+			log.Printf("[CREDENTIALS] Backend %v credentials rotated, used for new connections", backendName)
+		}
+	})
+}
+
+// fetchCredentials reads and validates the credentials yielded by source.
+func fetchCredentials(source string) ([]config.Credential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialFetchTimeout)
+	defer cancel()
+
+	var data []byte
+	var err error
+	if command, ok := strings.CutPrefix(source, "exec:"); ok {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, errors.New("empty command")
+		}
+		data, err = exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	} else {
+		data, err = fetchCredentialURL(ctx, source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []config.Credential
+	data = []byte(strings.TrimSpace(string(data)))
+	if strings.HasPrefix(string(data), "[") {
+		err = json.Unmarshal(data, &credentials)
+	} else {
+		var credential config.Credential
+		err = json.Unmarshal(data, &credential)
+		credentials = []config.Credential{credential}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(credentials) == 0 {
+		return nil, errors.New("no credentials")
+	}
+	for i, elem := range credentials {
+		if elem.CredentialUser == "" || elem.CredentialPass == "" {
+			return nil, fmt.Errorf("credential %d: user and password are required", i)
+		}
+		if strings.ContainsAny(elem.CredentialUser+elem.CredentialPass, "\r\n") || strings.Contains(elem.CredentialUser, " ") {
+			return nil, fmt.Errorf("credential %d: invalid characters", i)
+		}
+	}
+	return credentials, nil
+}
+
+func fetchCredentialURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
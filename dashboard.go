@@ -0,0 +1,97 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+type dashboardBackend struct {
+	Name      string
+	Active    int
+	Max       int
+	Percent   int
+	Unhealthy bool
+}
+
+type dashboardUser struct {
+	Name   string
+	Active int
+	Max    int
+}
+
+type dashboardData struct {
+	Backends     []dashboardBackend
+	Users        []dashboardUser
+	AuthFailures []authFailure
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<link rel="icon" href="data:,">
+<title>NNTP Proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { padding: 4px 12px; text-align: left; }
+.bar { width: 200px; height: 12px; background: #ddd; }
+.fill { height: 12px; background: #4a8; }
+.unhealthy .fill { background: #c44; }
+</style>
+</head>
+<body>
+<h2>Backends</h2>
+<table>
+<tr><th>Name</th><th>Connections</th><th>Utilization</th></tr>
+{{range .Backends}}<tr{{if .Unhealthy}} class="unhealthy"{{end}}><td>{{.Name}}{{if .Unhealthy}} (unhealthy){{end}}</td><td>{{.Active}} / {{.Max}}</td><td><div class="bar"><div class="fill" style="width: {{.Percent}}%"></div></div></td></tr>
+{{end}}</table>
+<h2>Users</h2>
+<table>
+<tr><th>Name</th><th>Connections</th></tr>
+{{range .Users}}<tr><td>{{.Name}}</td><td>{{.Active}} / {{.Max}}</td></tr>
+{{end}}</table>
+<h2>Recent authentication failures</h2>
+<table>
+<tr><th>Time</th><th>User</th><th>IP</th></tr>
+{{range .AuthFailures}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Username}}</td><td>{{.IP}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	data := dashboardData{}
+
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		b := dashboardBackend{
+			Name:      elem.BackendName,
+			Active:    backendConnections[elem.BackendName],
+			Max:       elem.BackendConns,
+			Unhealthy: backendUnhealthy[elem.BackendName],
+		}
+		if b.Max > 0 {
+			b.Percent = b.Active * 100 / b.Max
+		}
+		data.Backends = append(data.Backends, b)
+	}
+	for _, elem := range cfg.Users {
+		data.Users = append(data.Users, dashboardUser{elem.Username, userConnections[elem.Username], cfg.UserMaxConnections(elem)})
+	}
+	mu.Unlock()
+
+	recentAuthFailuresMu.Lock()
+	for i := len(recentAuthFailures) - 1; i >= 0; i-- {
+		data.AuthFailures = append(data.AuthFailures, recentAuthFailures[i])
+	}
+	recentAuthFailuresMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("[HTTP] Rendering dashboard failed: %v", err)
+	}
+}
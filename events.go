@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// eventQueueSize is how many events may wait for the event socket before
+// new ones are dropped.
+const eventQueueSize = 1024
+
+// event is one session lifecycle or authentication event, sent as a JSON
+// datagram to FrontendEventSocket.
+type event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	User   string    `json:"user,omitempty"`
+	IP     string    `json:"ip"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+var (
+	events        chan event
+	eventsDropped atomic.Int64
+)
+
+// startEvents starts sending events to FrontendEventSocket, if configured.
+// The socket is dialed by the sender, so a consumer may start after the
+// proxy.
+func startEvents() {
+	if cfg.Frontend.FrontendEventSocket == "" {
+		return
+	}
+
+	events = make(chan event, eventQueueSize)
+	go sendEvents(cfg.Frontend.FrontendEventSocket)
+}
+
+// emitEvent queues an event without blocking the caller. Events are
+// dropped and counted while the queue is full.
+func emitEvent(name string, username string, ip string, detail string) {
+	if events == nil {
+		return
+	}
+
+	select {
+	case events <- event{time.Now(), name, username, ip, detail}:
+	default:
+		eventsDropped.Add(1)
+	}
+}
+
+// sendEvents writes queued events to the socket at path, dropping those that
+// cannot be delivered.
+func sendEvents(path string) {
+	var conn net.Conn
+	for e := range events {
+		if conn == nil {
+			var err error
+			conn, err = net.Dial("unixgram", path)
+			if err != nil {
+				eventsDropped.Add(1)
+				continue
+			}
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("[EVENTS] Encoding %v failed: %v", e.Event, err)
+			continue
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			eventsDropped.Add(1)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// helloFingerprints holds the ClientHello fingerprint of TLS connections
+// whose handshake has not been picked up by their session yet, keyed by
+// remote address.
+var helloFingerprints sync.Map
+
+// recordClientHello is used as GetConfigForClient to fingerprint the
+// handshake parameters offered by the client, JA3 style.
+func recordClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%v|%v|%v|%v|%v", hello.SupportedVersions, hello.CipherSuites, hello.SupportedCurves, hello.SupportedPoints, hello.SignatureSchemes, hello.SupportedProtos)
+	helloFingerprints.Store(hello.Conn.RemoteAddr().String(), hex.EncodeToString(h.Sum(nil))[:32])
+	return nil, nil
+}
+
+// clientFingerprint returns a fingerprint of the client: the SHA-256 of its
+// certificate if it sent one, else of its ClientHello. Plaintext
+// connections have none.
+func clientFingerprint(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	err := tlsConn.Handshake()
+	fingerprint, _ := helloFingerprints.LoadAndDelete(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		return "cert:" + hex.EncodeToString(sum[:])
+	}
+
+	if fingerprint == nil {
+		return ""
+	}
+	return "hello:" + fingerprint.(string)
+}
+
+// connectionSecurity describes the TLS version and cipher suite negotiated
+// on conn, or reports it as unencrypted.
+func connectionSecurity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "unencrypted"
+	}
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		return "tls handshake failed"
+	}
+
+	state := tlsConn.ConnectionState()
+	return tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+}
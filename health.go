@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthCheckTimeout = 10 * time.Second
+	startupProbeDelay  = 5 * time.Second
+	recoveryProbeDelay = 10 * time.Second
+
+	// defaultLatencyProbeInterval is the health check interval used for the
+	// lowestlatency strategy when FrontendHealthCheckInterval is not set.
+	defaultLatencyProbeInterval = 30 * time.Second
+)
+
+var (
+	// ready is set once the frontend listener accepts connections.
+	ready atomic.Bool
+
+	// backendUnhealthy marks backends taken out of rotation, and
+	// backendFailures/backendSuccesses count consecutive connection results.
+	// Guarded by mu.
+	backendUnhealthy = make(map[string]bool)
+	backendFailures  = make(map[string]int)
+	backendSuccesses = make(map[string]int)
+
+	// backendLastFailure is the time of the latest failed connection attempt
+	// per backend. Guarded by mu.
+	backendLastFailure = make(map[string]time.Time)
+
+	// backendLatency is the time the latest successful probe of each backend
+	// took to connect and read the greeting. Guarded by mu.
+	backendLatency = make(map[string]time.Duration)
+)
+
+// backendThresholds returns how many consecutive failures mark the backend
+// unhealthy and how many consecutive successes recover it. Must be called
+// with mu held.
+func backendThresholds(backendName string) (unhealthyAfter int, healthyAfter int) {
+	unhealthyAfter, healthyAfter = 1, 1
+	for _, elem := range cfg.Backend {
+		if elem.BackendName != backendName {
+			continue
+		}
+		if elem.BackendUnhealthyThreshold > 0 {
+			unhealthyAfter = elem.BackendUnhealthyThreshold
+		}
+		if elem.BackendHealthyThreshold > 0 {
+			healthyAfter = elem.BackendHealthyThreshold
+		}
+	}
+	return unhealthyAfter, healthyAfter
+}
+
+// markBackendFailed records a failed connection attempt. Once the backend
+// reaches its unhealthy threshold it is taken out of rotation and probed
+// until it recovers.
+func markBackendFailed(backendName string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	backendFailures[backendName]++
+	backendSuccesses[backendName] = 0
+	backendLastFailure[backendName] = time.Now()
+
+	unhealthyAfter, _ := backendThresholds(backendName)
+	if backendUnhealthy[backendName] || backendFailures[backendName] < unhealthyAfter {
+		return
+	}
+	backendUnhealthy[backendName] = true
+	log.Printf("[HEALTH] Backend %v is unhealthy after %v failures", backendName, backendFailures[backendName])
+
+	go recoverBackend(backendName)
+}
+
+// markBackendHealthy records a successful connection attempt, returning an
+// unhealthy backend to rotation once it reaches its healthy threshold.
+func markBackendHealthy(backendName string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	backendFailures[backendName] = 0
+	backendSuccesses[backendName]++
+
+	_, healthyAfter := backendThresholds(backendName)
+	if backendUnhealthy[backendName] && backendSuccesses[backendName] >= healthyAfter {
+		delete(backendUnhealthy, backendName)
+		log.Printf("[HEALTH] Backend %v is healthy", backendName)
+	}
+}
+
+// penalizeBackend deprioritizes the backend as after a failure, without
+// counting towards its unhealthy threshold.
+func penalizeBackend(backendName string) {
+	mu.Lock()
+	defer mu.Unlock()
+	backendLastFailure[backendName] = time.Now()
+}
+
+// failurePenalty returns how strongly selection should avoid the backend
+// because of its last failure, decaying from 1 right after the failure to 0
+// once penaltyDuration seconds have passed. Must be called with mu held.
+func failurePenalty(backendName string, penaltyDuration int) float64 {
+	last, ok := backendLastFailure[backendName]
+	if !ok || penaltyDuration <= 0 {
+		return 0
+	}
+
+	window := time.Duration(penaltyDuration) * time.Second
+	elapsed := time.Since(last)
+	if elapsed >= window {
+		return 0
+	}
+	return 1 - float64(elapsed)/float64(window)
+}
+
+// pickFastestLocked returns the candidate with the lowest probe latency.
+// Backends not probed yet come last. Must be called with mu held.
+func pickFastestLocked(candidates []int) int {
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		latency, ok := backendLatency[cfg.Backend[i].BackendName]
+		if !ok {
+			continue
+		}
+		bestLatency, bestOK := backendLatency[cfg.Backend[best].BackendName]
+		if !bestOK || latency < bestLatency {
+			best = i
+		}
+	}
+	return best
+}
+
+func isBackendUnhealthy(backendName string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return backendUnhealthy[backendName]
+}
+
+// recoverBackend probes an unhealthy backend until it is back in rotation.
+func recoverBackend(backendName string) {
+	for isBackendUnhealthy(backendName) {
+		time.Sleep(recoveryProbeDelay)
+
+		err := probeBackend(backendName)
+		if err == errNoProbeSlot {
+			continue
+		}
+		if err != nil {
+			log.Printf("[HEALTH] Backend %v still unhealthy: %v", backendName, err)
+			markBackendFailed(backendName)
+			continue
+		}
+		markBackendHealthy(backendName)
+	}
+}
+
+// checkBackends probes every backend in rotation each
+// FrontendHealthCheckInterval seconds, so a backend that went down is taken
+// out of rotation before sessions are sent to it, and the probe latency used
+// by the lowestlatency strategy stays current. Unhealthy backends are left
+// to recoverBackend.
+func checkBackends() {
+	interval := time.Duration(cfg.Frontend.FrontendHealthCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultLatencyProbeInterval
+	}
+	for range time.Tick(interval) {
+		for _, elem := range backendsSnapshot() {
+			if isBackendUnhealthy(elem.BackendName) {
+				continue
+			}
+
+			err := probeBackend(elem.BackendName)
+			if err == errNoProbeSlot {
+				// Every slot is in use by sessions, which keep failures
+				// reported on their own.
+				continue
+			}
+			if err != nil {
+				log.Printf("[HEALTH] Check of backend %v failed: %v", elem.BackendName, err)
+				markBackendFailed(elem.BackendName)
+				continue
+			}
+			markBackendHealthy(elem.BackendName)
+		}
+	}
+}
+
+// writeBackendHealth renders the health state of every backend.
+func writeBackendHealth(w io.Writer) {
+	var buf bytes.Buffer
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		state := "healthy"
+		if backendUnhealthy[elem.BackendName] {
+			state = "unhealthy"
+		}
+		latency := "latency unknown"
+		if d, ok := backendLatency[elem.BackendName]; ok {
+			latency = "latency " + d.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(&buf, "%v - %v / %v consecutive failures / %v\n", elem.BackendName, state, backendFailures[elem.BackendName], latency)
+	}
+	mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// errNoProbeSlot is returned by probeBackend when the backend has no free
+// connection slot or credential to probe with.
+var errNoProbeSlot = errors.New("no free connection for a probe")
+
+// probeBackend dials the backend and runs the greeting and login handshake,
+// recording how long the connection and greeting took. The probe takes a
+// connection slot and credential like a session does, so it logs in with the
+// configured credentials and stays within their limits.
+func probeBackend(backendName string) error {
+	mu.Lock()
+	var selectedBackend *config.SelectedBackend
+	for i, elem := range cfg.Backend {
+		if elem.BackendName == backendName && backendHasRoomLocked(i) {
+			selectedBackend = reserveBackendLocked(i)
+		}
+	}
+	mu.Unlock()
+	if selectedBackend == nil {
+		return errNoProbeSlot
+	}
+	defer func() {
+		mu.Lock()
+		releaseBackendLocked(selectedBackend)
+		mu.Unlock()
+	}()
+
+	start := time.Now()
+	conn, err := dialBackend(selectedBackend, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+
+	c := textproto.NewConn(conn)
+	_, _, err = c.ReadCodeLine(200)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	latency := time.Since(start)
+
+	conn, c, err = loginBackend(conn, c, selectedBackend)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	mu.Lock()
+	backendLatency[selectedBackend.BackendName] = latency
+	mu.Unlock()
+
+	c.PrintfLine("QUIT")
+	conn.Close()
+	return nil
+}
+
+// waitForBackend blocks until at least one backend passes a probe.
+func waitForBackend() {
+	for {
+		for _, elem := range backendsSnapshot() {
+			err := probeBackend(elem.BackendName)
+			if err == nil {
+				log.Printf("[HEALTH] Backend %v is up", elem.BackendName)
+				return
+			}
+			log.Printf("[HEALTH] Waiting for backend %v: %v", elem.BackendName, err)
+		}
+		time.Sleep(startupProbeDelay)
+	}
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "starting up")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ready")
+}
@@ -0,0 +1,35 @@
+package main
+
+import "sync"
+
+var (
+	// ipConnections counts the open client connections per IP, enforcing
+	// FrontendMaxConnsPerIP.
+	ipConnections   = make(map[string]int)
+	ipConnectionsMu sync.Mutex
+)
+
+// acquireIPConn counts a new connection from ip. It returns false without
+// counting it if ip already has FrontendMaxConnsPerIP connections open.
+func acquireIPConn(ip string) bool {
+	limit := cfg.Frontend.FrontendMaxConnsPerIP
+
+	ipConnectionsMu.Lock()
+	defer ipConnectionsMu.Unlock()
+
+	if limit > 0 && ipConnections[ip] >= limit {
+		return false
+	}
+	ipConnections[ip]++
+	return true
+}
+
+func releaseIPConn(ip string) {
+	ipConnectionsMu.Lock()
+	defer ipConnectionsMu.Unlock()
+
+	ipConnections[ip]--
+	if ipConnections[ip] <= 0 {
+		delete(ipConnections, ip)
+	}
+}
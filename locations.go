@@ -0,0 +1,47 @@
+package main
+
+import "log"
+
+// userIPs counts the authenticated sessions per user and client IP. Guarded
+// by mu.
+var userIPs = make(map[string]map[string]int)
+
+// trackUserIPLocked records a new session of user from ip. When the user is
+// already active from FrontendMaxDistinctIPsPerUser other addresses it logs
+// an alert and, with FrontendEnforceDistinctIPs, refuses the session by
+// returning false. Must be called with mu held.
+func trackUserIPLocked(user string, ip string) bool {
+	ips, ok := userIPs[user]
+	if !ok {
+		ips = make(map[string]int)
+		userIPs[user] = ips
+	}
+
+	limit := cfg.Frontend.FrontendMaxDistinctIPsPerUser
+	if limit > 0 && ips[ip] == 0 && len(ips) >= limit {
+		log.Printf("[WARN] User %v active from %v addresses, new login from %v", user, len(ips)+1, ip)
+		audit("shared-credentials", user, ip, "")
+		if cfg.Frontend.FrontendEnforceDistinctIPs {
+			return false
+		}
+	}
+
+	ips[ip]++
+	return true
+}
+
+// untrackUserIPLocked removes a session of user from ip. Must be called with
+// mu held.
+func untrackUserIPLocked(user string, ip string) {
+	ips, ok := userIPs[user]
+	if !ok {
+		return
+	}
+	ips[ip]--
+	if ips[ip] <= 0 {
+		delete(ips, ip)
+	}
+	if len(ips) == 0 {
+		delete(userIPs, user)
+	}
+}
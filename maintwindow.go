@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// maintenanceWindow is a parsed FrontendMaintenanceWindows entry.
+type maintenanceWindow struct {
+	name     string
+	schedule *cronSchedule
+	duration time.Duration
+	location *time.Location
+}
+
+var maintenanceWindows []maintenanceWindow
+
+// initMaintenanceWindows parses the configured maintenance windows.
+func initMaintenanceWindows() {
+	for i, elem := range cfg.Frontend.FrontendMaintenanceWindows {
+		schedule, err := parseCron(elem.WindowStart)
+		if err != nil {
+			log.Fatal("Config Maintenance Window Error: ", err)
+		}
+		if elem.WindowDuration <= 0 {
+			log.Fatal("Config Maintenance Window Error: windowDuration must be positive for ", elem.WindowStart)
+		}
+
+		location := time.Local
+		if elem.WindowTimezone != "" {
+			location, err = time.LoadLocation(elem.WindowTimezone)
+			if err != nil {
+				log.Fatal("Config Maintenance Window Error: ", err)
+			}
+		}
+
+		name := elem.WindowName
+		if name == "" {
+			name = fmt.Sprintf("window %v", i+1)
+		}
+		maintenanceWindows = append(maintenanceWindows, maintenanceWindow{name, schedule, time.Duration(elem.WindowDuration) * time.Second, location})
+	}
+}
+
+// activeMaintenanceWindow returns the name of the maintenance window in
+// effect now, or "" if there is none.
+func activeMaintenanceWindow() string {
+	now := time.Now()
+	for _, elem := range maintenanceWindows {
+		local := now.In(elem.location)
+		// The window is active if it started within its duration.
+		start := elem.schedule.next(local.Add(-elem.duration))
+		if !start.IsZero() && !start.After(local) {
+			return elem.name
+		}
+	}
+	return ""
+}
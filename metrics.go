@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLatencyKeys bounds the number of distinct command verbs tracked; any
+// further verbs are folded into "OTHER".
+const maxLatencyKeys = 32
+
+// latencyBuckets are the histogram bucket upper bounds.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+type latencyHistogram struct {
+	counts []uint64
+	total  uint64
+	max    time.Duration
+}
+
+var (
+	commandLatency   = make(map[string]*latencyHistogram)
+	commandLatencyMu sync.Mutex
+)
+
+func observeCommandLatency(verb string, d time.Duration) {
+	commandLatencyMu.Lock()
+	defer commandLatencyMu.Unlock()
+
+	h, ok := commandLatency[verb]
+	if !ok {
+		if len(commandLatency) >= maxLatencyKeys {
+			verb = "OTHER"
+			h, ok = commandLatency[verb]
+		}
+		if !ok {
+			h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+			commandLatency[verb] = h
+		}
+	}
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// percentile returns the upper bound of the bucket holding the q-th
+// quantile. Samples above the last bucket report the observed maximum.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	rank := uint64(q*float64(h.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if i < len(latencyBuckets) {
+				return latencyBuckets[i]
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// writeCommandLatency renders p50/p95/p99 per command verb.
+func writeCommandLatency(w io.Writer) {
+	var buf bytes.Buffer
+	commandLatencyMu.Lock()
+	verbs := make([]string, 0, len(commandLatency))
+	for verb := range commandLatency {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	for _, verb := range verbs {
+		h := commandLatency[verb]
+		fmt.Fprintf(&buf, "%v - p50 %v / p95 %v / p99 %v (%v commands)\n", verb, h.percentile(0.50), h.percentile(0.95), h.percentile(0.99), h.total)
+	}
+	commandLatencyMu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+var (
+	// rejectedCommands counts the commands refused per verb. Verbs that are
+	// not known NNTP commands are counted as "OTHER", so clients cannot
+	// grow the map.
+	rejectedCommands   = make(map[string]int64)
+	rejectedCommandsMu sync.Mutex
+)
+
+func countRejectedCommand(verb string) {
+	verb = strings.ToUpper(verb)
+	if !config.IsKnownCommand(verb) {
+		verb = "OTHER"
+	}
+
+	rejectedCommandsMu.Lock()
+	defer rejectedCommandsMu.Unlock()
+	rejectedCommands[verb]++
+}
+
+// rejectedCommandVerbs returns the verbs with rejections in sorted order
+// along with their counts.
+func rejectedCommandVerbs() ([]string, map[string]int64) {
+	rejectedCommandsMu.Lock()
+	defer rejectedCommandsMu.Unlock()
+
+	verbs := make([]string, 0, len(rejectedCommands))
+	counts := make(map[string]int64, len(rejectedCommands))
+	for verb, n := range rejectedCommands {
+		verbs = append(verbs, verb)
+		counts[verb] = n
+	}
+	sort.Strings(verbs)
+	return verbs, counts
+}
+
+// writeRejectedCommands renders how often each verb was refused.
+func writeRejectedCommands(w io.Writer) {
+	verbs, counts := rejectedCommandVerbs()
+	for _, verb := range verbs {
+		fmt.Fprintf(w, "%v - %v rejected\n", verb, counts[verb])
+	}
+}
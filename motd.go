@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// motd holds the message of the day appended to the welcome line.
+var motd atomic.Value
+
+// loadMOTD reads FrontendMOTDFile. The file must hold a single line, so it
+// cannot break the response; on error the current message is kept.
+func loadMOTD() error {
+	if cfg.Frontend.FrontendMOTDFile == "" {
+		return nil
+	}
+
+	file, err := os.ReadFile(cfg.Frontend.FrontendMOTDFile)
+	if err != nil {
+		return err
+	}
+
+	message := strings.TrimRight(string(file), "\r\n")
+	if strings.ContainsAny(message, "\r\n") {
+		return errors.New("message of the day must be a single line")
+	}
+
+	motd.Store(message)
+	return nil
+}
+
+func reloadMOTD() {
+	err := loadMOTD()
+	if err != nil {
+		log.Printf("[WARN] Reload of %v failed, keeping current message of the day: %v", cfg.Frontend.FrontendMOTDFile, err)
+	}
+}
+
+// welcomeLine returns the text of the 281 response sent after login.
+func welcomeLine() string {
+	line := "Welcome"
+	if cfg.Frontend.FrontendWelcomeMessage != "" {
+		line = cfg.Frontend.FrontendWelcomeMessage
+	}
+	if message, _ := motd.Load().(string); message != "" {
+		line += " " + message
+	}
+	return line
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rexjohannes/nntp-proxy-2/config"
 	"golang.org/x/crypto/bcrypt"
@@ -13,25 +16,91 @@ import (
 	"net/http"
 	"net/textproto"
 	"os"
+	"os/signal"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+const configPath = "/config/config.json"
+
+const defaultCloseDrainTimeout = 2 * time.Second
+
 var (
 	cfg                config.Configuration
 	backendConnections map[string]int
 	userConnections    map[string]int
+	groupConnections   map[string]int
+	selectCursor       int
+	dialSlots          map[string]chan struct{}
+	authSlots          chan struct{}
 	mu                 sync.Mutex
 )
 
 type session struct {
 	UserConnection    net.Conn
 	backendConnection net.Conn
+	client            *textproto.Conn
+	backend           *textproto.Conn
+	backendCompressed bool
 	command           string
 	selectedBackend   *config.SelectedBackend
 	username          string
+	backendHint       string
+	backendGroup      string
+	pinned            bool
+	fetchSlots        chan struct{}
+	security          string
+	maxCommands       int
+	modeReaderPending bool
+	logSampled        bool
+	metrics           sessionMetrics
+	backendSince      time.Time
+	backendAcquired   time.Time
+	connectionGroup   string
+	relayedPooled     bool
+	certPolicy        *config.Policy
+	backendBroken     bool
+	maxPostConns      int
+	clientWriter      *clientWriter
+	expired           atomic.Bool
+	posting           bool
+	lastGroup         string
+	commandLimiter    *tokenBucket
+	group             string
+	pendingArticle    string
+	streaming         bool
+	policy            *config.Policy
+	fingerprint       string
+}
+
+// readerCommands are refused until MODE READER is sent to a backend that
+// requires it.
+var readerCommands = map[string]bool{
+	"ARTICLE":   true,
+	"BODY":      true,
+	"HEAD":      true,
+	"STAT":      true,
+	"GROUP":     true,
+	"LISTGROUP": true,
+	"LAST":      true,
+	"NEXT":      true,
+	"OVER":      true,
+	"XOVER":     true,
+	"HDR":       true,
+	"XHDR":      true,
+	"XPAT":      true,
+	"NEWNEWS":   true,
 }
 
+// shuttingDown is set once a shutdown signal arrived, so the accept loops
+// treat their closed listeners as the end of the process rather than an
+// error.
+var shuttingDown atomic.Bool
+
 // Utils
 func HashPassword(password string) string {
 	bytes, _ := bcrypt.GenerateFromPassword([]byte(password), 10)
@@ -43,6 +112,23 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
+// verifyPassword runs CheckPasswordHash, waiting for a free slot first when
+// the number of concurrent bcrypt comparisons is capped.
+func verifyPassword(password, hash string) bool {
+	if authSlots != nil {
+		authSlots <- struct{}{}
+		defer func() { <-authSlots }()
+	}
+	return CheckPasswordHash(password, hash)
+}
+
+// debugf logs only with FrontendDebug enabled.
+func debugf(format string, v ...interface{}) {
+	if cfg.Frontend.FrontendDebug {
+		log.Printf("[DEBUG] "+format, v...)
+	}
+}
+
 func isCommandAllowed(command string) bool {
 	for _, elem := range cfg.Frontend.FrontendAllowedCommands {
 		if strings.ToLower(elem.FrontendCommand) == strings.ToLower(command) {
@@ -52,6 +138,33 @@ func isCommandAllowed(command string) bool {
 	return false
 }
 
+// clientIP returns the remote IP of conn without the port.
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// inMaintenance reports whether the maintenance sentinel file exists.
+func inMaintenance() bool {
+	if cfg.Frontend.FrontendMaintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(cfg.Frontend.FrontendMaintenanceFile)
+	return err == nil
+}
+
+func findBackend(name string) bool {
+	for _, elem := range backendsSnapshot() {
+		if strings.ToLower(elem.BackendName) == strings.ToLower(name) {
+			return true
+		}
+	}
+	return false
+}
+
 func LoadConfig(path string) config.Configuration {
 	file, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -67,16 +180,268 @@ func LoadConfig(path string) config.Configuration {
 	return configType
 }
 
+// checkConfigPerms warns if a file holding credentials is readable by
+// everyone, refusing to start when Frontend.StrictConfigPerms is set.
+func checkConfigPerms(path string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	if info.Mode().Perm()&0004 == 0 {
+		return
+	}
+
+	if cfg.Frontend.FrontendStrictConfigPerms {
+		log.Fatalf("Config File %v is world-readable (%v), refusing to start", path, info.Mode().Perm())
+	}
+	log.Printf("[WARN] Config File %v is world-readable (%v)", path, info.Mode().Perm())
+}
+
+// reloadUsers replaces the user list with the contents of
+// Frontend.UsersFile, keeping the current list if the file is invalid.
+func reloadUsers() {
+	users, err := config.LoadUsers(cfg.Frontend.FrontendUsersFile)
+	if err != nil {
+		log.Printf("[USERS] Reload of %v failed, keeping current users: %v", cfg.Frontend.FrontendUsersFile, err)
+		return
+	}
+
+	err = cfg.CheckUserPolicies(users)
+	if err != nil {
+		log.Printf("[USERS] Reload of %v failed, keeping current users: %v", cfg.Frontend.FrontendUsersFile, err)
+		return
+	}
+
+	mu.Lock()
+	cfg.Users = users
+	mu.Unlock()
+
+	log.Printf("[USERS] Reloaded %v users from %v", len(users), cfg.Frontend.FrontendUsersFile)
+}
+
+// acquireDialSlot blocks until the backend has room for another connection
+// in its dial/handshake phase and returns the function releasing the slot.
+func acquireDialSlot(backendName string) func() {
+	slots, ok := dialSlots[backendName]
+	if !ok {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
 // Utils
 
 // HTTP HANDLE
 
+// writeGroupConnections renders the shared connection count per group.
+func writeGroupConnections(w io.Writer) {
+	var buf bytes.Buffer
+	mu.Lock()
+	for _, elem := range cfg.ConnectionGroups {
+		fmt.Fprintf(&buf, "group %v - %v / %v\n", elem.GroupName, groupConnections[elem.GroupName], elem.GroupMaxConnections)
+	}
+	mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// writeUserConnections renders the connection count of every user against
+// their limit.
+func writeUserConnections(w io.Writer) {
+	type userCount struct {
+		name   string
+		active int
+		max    int
+	}
+
+	mu.Lock()
+	counts := []userCount{}
+	for _, elem := range cfg.Users {
+		counts = append(counts, userCount{elem.Username, userConnections[elem.Username], cfg.UserMaxConnections(elem)})
+	}
+	mu.Unlock()
+
+	for _, elem := range counts {
+		fmt.Fprintf(w, "user %v - %v / %v\n", elem.name, elem.active, elem.max)
+	}
+}
+
+type backendStatus struct {
+	Name   string `json:"name"`
+	Active int    `json:"active"`
+	Max    int    `json:"max"`
+}
+
+// wantsJSON reports whether the request asks for JSON with ?format=json or
+// its Accept header.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// snapshotBackendStatus copies the connection counts of every backend, so
+// mu is not held while the response is written.
+func snapshotBackendStatus() []backendStatus {
+	mu.Lock()
+	defer mu.Unlock()
+
+	status := []backendStatus{}
+	for _, elem := range cfg.Backend {
+		status = append(status, backendStatus{elem.BackendName, backendConnections[elem.BackendName], elem.BackendConns})
+	}
+	return status
+}
+
 func httpHandler(w http.ResponseWriter, r *http.Request) {
+	status := snapshotBackendStatus()
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 
-	for _, elem := range cfg.Backend {
-		fmt.Fprintf(w, "%v - %v / %v\n", elem.BackendName, backendConnections[elem.BackendName], elem.BackendConns)
+	for _, elem := range status {
+		fmt.Fprintf(w, "%v - %v / %v\n", elem.Name, elem.Active, elem.Max)
+	}
+
+	if window := activeMaintenanceWindow(); window != "" {
+		fmt.Fprintf(w, "Maintenance window %v active\n", window)
+	}
+
+	writePoolUsage(w)
+	writeBackendHealth(w)
+	writeBackendHolds(w)
+	writeGroupConnections(w)
+	writeUserConnections(w)
+	writeQuotas(w)
+	writeUserQuotas(w)
+	writeCredentialUsage(w)
+	writeCommandLatency(w)
+	writeRejectedCommands(w)
+
+	if cfg.Frontend.FrontendArticleNumberCache {
+		fmt.Fprintf(w, "Article number cache - %v entries\n", articleNumbers.len())
+	}
+}
+
+// configHandler returns the running configuration with secrets redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	running := cfg.Redacted()
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(running)
+}
+
+// isTrustedProxy reports whether ip matches one of the configured trusted
+// proxy addresses or CIDR ranges.
+func isTrustedProxy(ip string) bool {
+	return ipInList(ip, cfg.Frontend.FrontendHTTPTrustedProxies)
+}
+
+// ipInList reports whether ip matches one of the addresses or CIDR ranges
+// in list.
+func ipInList(ip string, list []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, elem := range list {
+		if strings.Contains(elem, "/") {
+			_, network, err := net.ParseCIDR(elem)
+			if err == nil && network.Contains(parsed) {
+				return true
+			}
+		} else if parsed.Equal(net.ParseIP(elem)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client networks of FrontendAllowedCIDRs and FrontendDeniedCIDRs.
+var allowedNetworks, deniedNetworks []*net.IPNet
+
+// clientNetworkAllowed reports whether a client may connect from ip. Denied
+// networks take precedence, and an empty allow list allows everyone else.
+func clientNetworkAllowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, elem := range deniedNetworks {
+		if elem.Contains(parsed) {
+			return false
+		}
+	}
+	if len(allowedNetworks) == 0 {
+		return true
+	}
+	for _, elem := range allowedNetworks {
+		if elem.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpClientIP returns the IP of the HTTP client. X-Forwarded-For is only
+// honored when the request comes from a trusted proxy, and is read from the
+// right so that addresses added by the client itself are ignored.
+func httpClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// requireHTTPAuth wraps handler with HTTP basic auth when
+// Frontend.HTTPUser is configured. HTTPPass is a bcrypt hash.
+func requireHTTPAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Frontend.FrontendHTTPUser != "" {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != cfg.Frontend.FrontendHTTPUser || !verifyPassword(password, cfg.Frontend.FrontendHTTPPass) {
+				log.Printf("[HTTP] Unauthorized request for %v from %v", r.URL.Path, httpClientIP(r))
+				w.Header().Set("WWW-Authenticate", `Basic realm="nntp-proxy"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
 	}
 }
 
@@ -84,24 +449,144 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
-	cfg = LoadConfig("/config/config.json")
+	cfg = LoadConfig(configPath)
+	checkConfigPerms(configPath)
+
+	if cfg.Frontend.FrontendUsersFile != "" {
+		users, err := config.LoadUsers(cfg.Frontend.FrontendUsersFile)
+		if err != nil {
+			log.Fatal("Users File Error: ", err)
+		}
+		cfg.Users = users
+		checkConfigPerms(cfg.Frontend.FrontendUsersFile)
+		watchUserReloadSignal()
+	}
+
+	err := cfg.CheckUserPolicies(cfg.Users)
+	if err != nil {
+		log.Fatal("Config Policy Error: ", err)
+	}
+
+	switch cfg.Frontend.FrontendBackendStrategy {
+	case "", "fillfirst", "roundrobin", "leastconn", "weighted", "lowestlatency":
+	default:
+		log.Fatal("Config Strategy Error: unknown backend strategy ", cfg.Frontend.FrontendBackendStrategy)
+	}
+
+	for _, elem := range cfg.UnknownAllowedCommands() {
+		if cfg.Frontend.FrontendStrictAllowedCommands {
+			log.Fatal("Config Command Error: unknown allowed command ", elem)
+		}
+		log.Printf("[WARN] Allowed command %v is not a known NNTP command", elem)
+	}
+
+	authorizers, err = buildAuthorizers(cfg)
+	if err != nil {
+		log.Fatal("Config Authorizer Error: ", err)
+	}
+
+	err = cfg.CheckCertPolicies()
+	if err != nil {
+		log.Fatal("Config Certificate Policy Error: ", err)
+	}
+
+	err = cfg.CheckListenerGroups()
+	if err != nil {
+		log.Fatal("Config Listener Error: ", err)
+	}
+
+	for _, elem := range cfg.Backend {
+		if elem.BackendPinnedCertSHA256 != "" {
+			err := checkPinnedCert(elem.BackendPinnedCertSHA256)
+			if err != nil {
+				log.Fatal("Config TLS Pin Error: ", err)
+			}
+		} else if elem.BackendInsecureSkipVerify && (elem.BackendTLS || elem.BackendStartTLS) {
+			log.Printf("[WARN] Backend %v: TLS certificate is not verified", elem.BackendName)
+		}
+	}
+
+	allowedNetworks, deniedNetworks, err = cfg.ClientNetworks()
+	if err != nil {
+		log.Fatal("Config Network Error: ", err)
+	}
+
+	if cfg.Frontend.FrontendDebug {
+		effective, _ := json.Marshal(cfg.Redacted())
+		debugf("Effective configuration: %s", effective)
+	}
 
 	backendConnections = make(map[string]int)
 	userConnections = make(map[string]int)
+	groupConnections = make(map[string]int)
 
-	for _, elem := range cfg.Backend {
-		backendConnections[elem.BackendName] = 0
+	dialSlots = make(map[string]chan struct{})
+
+	articleNumbers.size = cfg.Frontend.FrontendArticleNumberCacheSize
+
+	initQuotas()
+	initUserQuotas()
+	initMaintenanceWindows()
+	initSpool()
+	startCredentialSources()
+
+	if cfg.Frontend.FrontendAuditLog != "" {
+		err := openAuditLog()
+		if err != nil {
+			log.Fatal("Audit Log Error: ", err)
+		}
+		watchAuditReopenSignal()
+	}
+
+	startEvents()
+
+	if strings.ContainsAny(cfg.Frontend.FrontendWelcomeMessage, "\r\n") {
+		log.Fatal("Config Welcome Error: frontendWelcomeMessage must be a single line")
+	}
+
+	for _, elem := range []string{cfg.Frontend.FrontendUnknownCommandResponse, cfg.Frontend.FrontendDisallowedCommandResponse} {
+		if elem != "" && (strings.ContainsAny(elem, "\r\n") || responseCode(elem) < 400) {
+			log.Fatal("Config Command Response Error: responses must be a single line with an error code, got ", elem)
+		}
+	}
+
+	err = loadMOTD()
+	if err != nil {
+		log.Fatal("MOTD File Error: ", err)
+	}
+
+	watchCredentialReloadSignal()
+
+	if cfg.Frontend.FrontendMaxConcurrentAuth > 0 {
+		authSlots = make(chan struct{}, cfg.Frontend.FrontendMaxConcurrentAuth)
 	}
 
-	var l net.Listener
+	for _, elem := range backendsSnapshot() {
+		backendConnections[elem.BackendName] = 0
+		if elem.BackendMaxConcurrentDials > 0 {
+			dialSlots[elem.BackendName] = make(chan struct{}, elem.BackendMaxConcurrentDials)
+		}
+	}
 
-	http.HandleFunc("/backendStatus", httpHandler)
+	http.HandleFunc("/backendStatus", requireHTTPAuth(httpHandler))
+	http.HandleFunc("/dashboard", requireHTTPAuth(dashboardHandler))
+	http.HandleFunc("/config", requireHTTPAuth(configHandler))
+	http.HandleFunc("/state", requireHTTPAuth(stateHandler))
+	http.HandleFunc("/metrics", requireHTTPAuth(newMetricsHandler()))
+	http.HandleFunc("/ready", readyHandler)
 	go http.ListenAndServe(cfg.Frontend.FrontendHTTPAddr+":"+cfg.Frontend.FrontendHTTPPort, nil)
 
-	if cfg.Frontend.FrontendTLS {
+	if cfg.Frontend.FrontendHealthCheckInterval > 0 || cfg.Frontend.FrontendBackendStrategy == "lowestlatency" {
+		go checkBackends()
+	}
 
-		// New var for error
-		var err error
+	if cfg.Frontend.FrontendWaitForBackend {
+		waitForBackend()
+	}
+
+	var tlsConf *tls.Config
+
+	if cfg.Frontend.FrontendTLS {
 
 		// try to load cert pair
 		cer, err := tls.LoadX509KeyPair(cfg.Frontend.FrontendTLSCert, cfg.Frontend.FrontendTLSKey)
@@ -111,53 +596,126 @@ func main() {
 			return
 		}
 
+		checkFrontendCertificate(cer)
+
 		// Set certs
-		tlsConf := &tls.Config{Certificates: []tls.Certificate{cer}}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cer}}
 
-		// Listen for incoming TLS connections.
-		l, err = tls.Listen("tcp", cfg.Frontend.FrontendAddr+":"+cfg.Frontend.FrontendPort, tlsConf)
+		if cfg.Frontend.FrontendLogClientFingerprint {
+			tlsConf.GetConfigForClient = recordClientHello
+		}
 
-		if err != nil {
-			log.Printf("%v", err)
-			os.Exit(1)
+		if certPoliciesEnabled() {
+			err = configureClientCerts(tlsConf)
+			if err != nil {
+				log.Fatal("Client CA Error: ", err)
+			}
 		}
+	}
 
-		log.Printf("[TLS] Listening on %v:%v", cfg.Frontend.FrontendAddr, cfg.Frontend.FrontendPort)
+	l := listen(cfg.Frontend.FrontendAddr, cfg.Frontend.FrontendPort, tlsConf)
 
-	} else {
+	// Close the listener when the application closes.
+	defer l.Close()
 
-		// New var for error
-		var err error
+	listeners := []net.Listener{l}
+	for _, elem := range cfg.Frontend.FrontendListeners {
+		extra := listen(elem.ListenerAddr, elem.ListenerPort, tlsConf)
+		listeners = append(listeners, extra)
+		go serve(extra, elem.ListenerBackendGroup)
+	}
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+
+		log.Printf("Received %v, shutting down", sig)
+		shuttingDown.Store(true)
+		for _, elem := range listeners {
+			elem.Close()
+		}
+	}()
+
+	if cfg.Frontend.FrontendLogSampleRate > 0 {
+		go logUnauthenticatedSummary()
+	}
+
+	if cfg.Frontend.FrontendPerCommandBackend || cfg.Frontend.FrontendPoolSessions {
+		go reapIdleConns()
+		go probeIdleConns()
+	}
+
+	ready.Store(true)
+
+	serve(l, "")
+
+	saveQuotas()
+	saveUserQuotas()
+	logSummary()
+}
+
+// listen opens a frontend listener, using TLS when tlsConf is set.
+func listen(addr string, port string, tlsConf *tls.Config) net.Listener {
+	if tlsConf != nil {
 
-		// Listen for incoming connections.
-		l, err = net.Listen("tcp", cfg.Frontend.FrontendAddr+":"+cfg.Frontend.FrontendPort)
+		// Listen for incoming TLS connections.
+		l, err := tls.Listen("tcp", addr+":"+port, tlsConf)
 
 		if err != nil {
 			log.Printf("%v", err)
 			os.Exit(1)
 		}
 
-		log.Printf("[PLAIN - DO NOT USE PROD!] Listening on %v:%v", cfg.Frontend.FrontendAddr, cfg.Frontend.FrontendPort)
+		log.Printf("[TLS] Listening on %v:%v", addr, port)
+		return l
 	}
 
-	// Close the listener when the application closes.
-	defer l.Close()
+	// Listen for incoming connections.
+	l, err := net.Listen("tcp", addr+":"+port)
+
+	if err != nil {
+		log.Printf("%v", err)
+		os.Exit(1)
+	}
+
+	log.Printf("[PLAIN - DO NOT USE PROD!] Listening on %v:%v", addr, port)
+	return l
+}
 
+// serve accepts connections on l. Sessions from the listener only use
+// backends of backendGroup, or any backend if it is empty.
+func serve(l net.Listener, backendGroup string) {
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) && shuttingDown.Load() {
+			return
+		}
 		if err != nil {
 			fmt.Println("Error accepting: ", err.Error())
 			os.Exit(1)
 		}
+		// Sessions are counted here rather than in handleRequest, so a
+		// burst of connections cannot overshoot the limit.
+		if !sessionStarted() {
+			go refuseConnection(conn, "400 Server busy")
+			continue
+		}
 		// Handle connections in a new goroutine.
-		go handleRequest(conn)
+		go handleRequest(conn, backendGroup)
 	}
 }
 
 func (s *session) dispatchCommand() {
 
-	log.Printf("[Dispatch] Command : %v", s.command)
+	// Some clients send stray blank lines, which name no command.
+	if strings.TrimSpace(s.command) == "" {
+		s.client.PrintfLine("500 command not recognized")
+		return
+	}
+
+	s.logf("[Dispatch] Command : %v", s.command)
 
 	cmd := strings.Split(s.command, " ")
 
@@ -169,197 +727,1416 @@ func (s *session) dispatchCommand() {
 
 	if strings.ToLower(cmd[0]) == "authinfo" {
 		s.handleAuth(args)
+	} else if strings.ToLower(cmd[0]) == "xbackend" && cfg.Frontend.FrontendAllowBackendHint {
+		s.handleBackendHint(args)
+	} else if cfg.Frontend.FrontendKeepaliveCommand != "" && strings.EqualFold(cmd[0], cfg.Frontend.FrontendKeepaliveCommand) {
+		// Answered locally; reading the line already counts as activity.
+		s.client.PrintfLine("200 ok")
+	} else if s.modeReaderPending && strings.ToLower(cmd[0]) == "mode" && len(args) == 1 && strings.ToLower(args[0]) == "reader" {
+		s.handleRequests("MODE")
+	} else if strings.ToLower(cmd[0]) == "mode" && len(args) == 1 && strings.ToLower(args[0]) == "stream" {
+		s.handleModeStream()
+	} else if s.streaming && (strings.ToLower(cmd[0]) == "check" || strings.ToLower(cmd[0]) == "takethis") {
+		s.handleRequests(strings.ToUpper(cmd[0]))
+	} else if s.policy != nil && !s.policy.AllowsCommand(cmd[0]) {
+		s.rejectCommand(cmd[0])
+	} else if s.policy != nil && (strings.ToLower(cmd[0]) == "group" || strings.ToLower(cmd[0]) == "listgroup") && len(args) > 0 && !s.policy.AllowsGroup(args[0]) {
+		s.client.PrintfLine("411 No such newsgroup")
 	} else {
 		if isCommandAllowed(strings.ToLower(cmd[0])) {
-			s.handleRequests()
+			s.handleRequests(strings.ToUpper(cmd[0]))
 		} else {
-			t := textproto.NewConn(s.UserConnection)
-
-			t.PrintfLine("502 %s not allowed", cmd[0])
+			s.rejectCommand(cmd[0])
 			return
 		}
 
 	}
 }
 
-func (s *session) handleRequests() {
-	if s.backendConnection != nil {
+// rejectCommand answers a command the session may not use, telling unknown
+// verbs apart from known but disallowed ones.
+func (s *session) rejectCommand(verb string) {
+	countRejectedCommand(verb)
 
-		s.backendConnection.Write([]byte(s.command + "\n"))
+	if !config.IsKnownCommand(verb) {
+		if cfg.Frontend.FrontendUnknownCommandResponse != "" {
+			s.refuseCommand(verb, cfg.Frontend.FrontendUnknownCommandResponse)
+		} else {
+			s.refuseCommand(verb, "500 command not recognized")
+		}
+		return
+	}
 
-		go io.Copy(s.backendConnection, s.UserConnection)
-		io.Copy(s.UserConnection, s.backendConnection)
+	if cfg.Frontend.FrontendDisallowedCommandResponse != "" {
+		s.refuseCommand(verb, cfg.Frontend.FrontendDisallowedCommandResponse)
+	} else {
+		s.refuseCommand(verb, fmt.Sprintf("502 %s not allowed", verb))
 	}
 }
 
-func (s *session) handleAuthorization(user string, password string) (bool, string) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	for _, elem := range cfg.Users {
-		if elem.Username == user && CheckPasswordHash(password, elem.Password) {
-			if userConnections[user] >= elem.MaxConnections {
-				return false, "502 Too Many Connections"
-			}
-			userConnections[user]++
-			return true, ""
+// refuseCommand answers the current command with status instead of relaying
+// it. TAKETHIS has already sent its article, which is read and discarded
+// first; it is always refused with 439 so the peer does not mistake the
+// article for commands.
+func (s *session) refuseCommand(verb string, status string) {
+	if strings.EqualFold(verb, "TAKETHIS") {
+		copyDataBlock(io.Discard, s.client.R, nil)
+		status = "439"
+		if fields := strings.Fields(s.command); len(fields) > 1 {
+			status += " " + fields[1]
 		}
 	}
-	return false, "502 Authentication Failed"
+	s.client.PrintfLine("%s", status)
 }
 
-func (s *session) handleAuth(args []string) {
-	t := textproto.NewConn(s.UserConnection)
-
-	if len(args) < 2 {
-		t.PrintfLine("502 Unknown Syntax!")
+// handleRequests forwards the current command to the backend and relays its
+// response, including any multi-line data block, back to the client.
+func (s *session) handleRequests(verb string) {
+	if s.backendConnection == nil {
+		s.refuseCommand(verb, "480 Authentication Required")
 		return
 	}
 
-	if strings.ToLower(args[0]) != "user" {
-		t.PrintfLine("502 Unknown Syntax!")
+	if s.modeReaderPending && readerCommands[verb] {
+		s.refuseCommand(verb, "480 MODE READER required")
 		return
 	}
 
-	t.PrintfLine("381 Continue")
+	if (verb == "POST" || verb == "IHAVE") && !s.posting && !s.startPosting() {
+		if verb == "IHAVE" {
+			s.client.PrintfLine("436 Too many posting connections")
+		} else {
+			s.client.PrintfLine("440 Too many posting connections")
+		}
+		return
+	}
 
-	a, _ := t.ReadLine()
-	parts := strings.SplitN(a, " ", 3)
+	if s.commandLimiter != nil {
+		wait, ok := s.commandLimiter.reserve(maxRateLimitDelay)
+		if !ok {
+			s.refuseCommand(verb, "502 Rate limit exceeded")
+			return
+		}
+		time.Sleep(wait)
+	}
+
+	if verb == "GROUP" || verb == "LISTGROUP" {
+		if cfg.Frontend.FrontendMaxGroupSwitches > 0 && s.metrics.groupSwitches >= cfg.Frontend.FrontendMaxGroupSwitches {
+			s.client.PrintfLine("400 too many group selections")
+			return
+		}
+		s.metrics.groupSwitches++
+		s.pinned = true
+	}
+
+	if !acquireUserCommand(s.username, s.maxCommands) {
+		s.refuseCommand(verb, "400 too many concurrent requests")
+		return
+	}
+	defer releaseUserCommand(s.username, s.maxCommands)
+
+	if s.fetchSlots != nil && isArticleFetch(verb) {
+		// Queue behind the fetches already in flight for this session.
+		s.fetchSlots <- struct{}{}
+		defer func() { <-s.fetchSlots }()
+	}
+
+	if isArticleFetch(verb) {
+		s.metrics.fetchStarted()
+		defer s.metrics.fetchEnded()
+	}
+
+	name, number := spoolName(verb, s.command), ""
+	if name == "" {
+		name, number = s.spooledByNumber(verb)
+	}
+	if name != "" {
+		start := time.Now()
+		served, n, err := s.serveSpooled(name, number)
+		if served {
+			if number != "" {
+				s.pendingArticle = number
+			}
+			s.metrics.bytesOut += n
+			addUserBytes(s.username, n)
+			if err != nil {
+				log.Printf("[SPOOL] Sending %v to %v failed: %v", s.command, clientIP(s.UserConnection), err)
+				s.closeClient("400 Timeout")
+				return
+			}
+			observeCommandLatency(verb, time.Since(start))
+			s.metrics.observeCommand(time.Since(start))
+			return
+		}
+	}
+
+	if s.selectedBackend.BackendConnLeaseTTL > 0 && time.Since(s.backendSince) > time.Duration(s.selectedBackend.BackendConnLeaseTTL)*time.Second {
+		err := s.renewBackendConn()
+		if err != nil {
+			log.Printf("[RELAY] Backend %v: renewing connection failed: %v", s.selectedBackend.BackendName, err)
+			markBackendFailed(s.selectedBackend.BackendName)
+			s.backendBroken = true
+			s.closeClient("400 Backend connection lost")
+			return
+		}
+	}
+
+	start := time.Now()
+
+	backendName := s.selectedBackend.BackendName
+	s.relayedPooled = false
+	var err error
+	if cfg.Frontend.FrontendPerCommandBackend && !s.pinned && isPoolableCommand(verb, s.command) {
+		backendName, err = s.relayPooled(verb)
+	} else {
+		err = s.syncCurrentArticle(verb)
+		if err == nil {
+			_, err = s.relayCommand(verb)
+		}
+	}
+	if err == errSlowBackend {
+		backendName, err = s.failoverSlowBackend(verb, backendName)
+	}
+	if errors.Is(err, errClientStalled) {
+		log.Printf("[RELAY] Client %v stopped reading, closing", clientIP(s.UserConnection))
+		s.backendBroken = true
+		s.closeClient("400 Timeout")
+		return
+	}
+	if err != nil {
+		log.Printf("[RELAY] Backend %v: %v", backendName, err)
+		// A failed pooled connection leaves the session's own one intact.
+		s.backendBroken = !s.relayedPooled
+		s.closeClient("400 Backend connection lost")
+		return
+	}
+
+	observeCommandLatency(verb, time.Since(start))
+	s.metrics.observeCommand(time.Since(start))
+}
+
+// relayCommand sends the current command to the backend and relays the
+// response. It returns the response status line.
+func (s *session) relayCommand(verb string) (string, error) {
+	err := s.backend.PrintfLine("%s", s.command)
+	if err != nil {
+		return "", err
+	}
+
+	if verb == "TAKETHIS" {
+		// TAKETHIS carries the article inline, without waiting for a
+		// go-ahead from the server.
+		var n int64
+		n, err = copyDataBlock(s.backend.W, s.client.R, nil)
+		s.metrics.bytesIn += n
+		if err == nil {
+			err = s.backend.W.Flush()
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Idempotent reads may fail over to another backend as long as nothing
+	// has been relayed to the client yet.
+	timeout := time.Duration(s.selectedBackend.BackendMaxResponseTime) * time.Second
+	if timeout > 0 && isPoolableCommand(verb, s.command) {
+		s.backendConnection.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	line, err := s.backend.ReadLine()
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "", errSlowBackend
+		}
+		return "", err
+	}
+	s.backendConnection.SetReadDeadline(time.Time{})
+
+	// 401 asks for another mode, which for a reader proxy is MODE READER.
+	// TAKETHIS is not retried, its article has already been sent.
+	if responseCode(line) == 401 && verb != "MODE" && verb != "TAKETHIS" {
+		line, err = s.retryInReaderMode(line)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	proxied := int64(len(s.command) + len(line) + 4)
+	s.metrics.bytesIn += int64(len(s.command) + 2)
+	s.metrics.bytesOut += int64(len(line) + 2)
+	addUserBytes(s.username, int64(len(line)+2))
+	defer func() { addBackendBytes(s.selectedBackend, proxied) }()
+
+	// Only the client sees the translated code; the relay keeps following
+	// what the backend actually sent.
+	err = s.client.PrintfLine("%s", translateResponse(s.selectedBackend.BackendResponseMap, line))
+	if err != nil {
+		return line, err
+	}
+
+	if (verb == "GROUP" || verb == "LISTGROUP") && responseCode(line) == 211 {
+		if fields := strings.Fields(s.command); len(fields) > 1 {
+			s.metrics.addGroup(fields[1])
+			s.lastGroup = fields[1]
+		}
+	}
+
+	if verb == "MODE" && responseCode(line) == 203 {
+		s.streaming = true
+	}
+
+	if verb == "MODE" && (responseCode(line) == 200 || responseCode(line) == 201) {
+		s.modeReaderPending = false
+	}
+
+	// Once the backend asks for the article of a POST or IHAVE, the client
+	// sends it as a data block and the backend answers with its verdict.
+	if (verb == "POST" && responseCode(line) == 340) || (verb == "IHAVE" && responseCode(line) == 335) {
+		return s.relayArticle(&proxied)
+	}
+
+	var observe func([]byte)
+	if cfg.Frontend.FrontendArticleNumberCache {
+		observe = s.observeResponse(verb, line)
+	}
+
+	if !isMultilineResponse(verb, line) {
+		return line, nil
+	}
+
+	// Optionally truncate LIST output; the remainder is still read from the
+	// backend and the terminating dot always relayed.
+	maxLines, lines := 0, 0
+	if verb == "LIST" {
+		maxLines = cfg.Frontend.FrontendMaxListLines
+	}
+	filter := func(data []byte) bool {
+		if observe != nil {
+			observe(data)
+		}
+		lines++
+		return maxLines <= 0 || lines <= maxLines
+	}
+
+	// Data blocks are sent with Nagle's algorithm, so the client gets full
+	// segments; status lines keep going out immediately.
+	if cfg.Frontend.FrontendAdaptiveNoDelay {
+		s.clientWriter.setNoDelay(false)
+		defer s.clientWriter.setNoDelay(true)
+	}
+
+	// Articles are collected for the spool alongside the relay.
+	var dst io.Writer = s.client.W
+	var tee *spoolBuffer
+	name := spoolName(verb, s.command)
+	if name != "" && ((verb == "ARTICLE" && responseCode(line) == 220) || (verb == "BODY" && responseCode(line) == 222)) {
+		tee = newSpoolBuffer(line)
+		dst = io.MultiWriter(s.client.W, tee)
+	}
+
+	var n int64
+	if s.backendCompressed {
+		n, err = copyCompressedDataBlock(dst, s.backend.R, filter)
+	} else {
+		n, err = copyDataBlock(dst, s.backend.R, filter)
+	}
+	proxied += n
+	s.metrics.bytesOut += n
+	addUserBytes(s.username, n)
+	if err != nil {
+		if tee != nil {
+			tee.finish(name, false)
+		}
+		return line, err
+	}
+
+	if maxLines > 0 && lines > maxLines {
+		log.Printf("[RELAY] Truncated %v response for %v from %v to %v lines", verb, s.username, lines, maxLines)
+	}
+
+	err = s.client.W.Flush()
+	if tee != nil {
+		tee.finish(name, err == nil)
+	}
+	return line, err
+}
+
+// relayArticle copies the article of a POST or IHAVE from the client to the
+// backend and relays the backend's final response. It returns that response
+// and adds the bytes moved to proxied.
+func (s *session) relayArticle(proxied *int64) (string, error) {
+	n, err := copyDataBlock(s.backend.W, s.client.R, nil)
+	*proxied += n
+	s.metrics.bytesIn += n
+	if err == nil {
+		err = s.backend.W.Flush()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	line, err := s.backend.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	*proxied += int64(len(line) + 2)
+	s.metrics.bytesOut += int64(len(line) + 2)
+	addUserBytes(s.username, int64(len(line)+2))
+
+	return line, s.client.PrintfLine("%s", translateResponse(s.selectedBackend.BackendResponseMap, line))
+}
+
+// handleModeStream forwards MODE STREAM to the backend if streaming is
+// enabled. Once the backend accepts with 203 the session may use CHECK and
+// TAKETHIS.
+func (s *session) handleModeStream() {
+	if !cfg.Frontend.FrontendAllowStreaming {
+		s.client.PrintfLine("501 streaming not supported")
+		return
+	}
+
+	s.handleRequests("MODE")
+}
+
+func (s *session) handleAuthorization(user string, password string) (bool, string) {
+	elem := authorize(user, password, clientIP(s.UserConnection))
+	if elem == nil {
+		recordAuthFailure(user, clientIP(s.UserConnection))
+		audit("login-failed", user, clientIP(s.UserConnection), "")
+		return false, "502 Authentication Failed"
+	}
+
+	if len(elem.AllowedIPs) > 0 && !ipInList(clientIP(s.UserConnection), elem.AllowedIPs) {
+		recordAuthFailure(user, clientIP(s.UserConnection))
+		audit("login-denied", user, clientIP(s.UserConnection), "address not allowed")
+		return false, "481 Authentication not allowed from this address"
+	}
 
-	if strings.ToLower(parts[0]) != "authinfo" || strings.ToLower(parts[1]) != "pass" {
+	if userQuotaExceeded(user, elem.MaxBytes) {
+		audit("login-denied", user, clientIP(s.UserConnection), "quota exceeded")
+		return false, "502 Quota exceeded"
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !waitUserConnLocked(user, cfg.UserMaxConnections(*elem)) {
+		return false, "502 Too Many Connections"
+	}
+	if elem.MaxReadConnections > 0 && readConnectionsLocked(user) >= elem.MaxReadConnections {
+		return false, "502 Too Many Connections"
+	}
+	group := cfg.FindConnectionGroup(elem.ConnectionGroup)
+	if group != nil && groupConnections[group.GroupName] >= group.GroupMaxConnections {
+		return false, "502 Too Many Connections"
+	}
+	if !trackUserIPLocked(user, clientIP(s.UserConnection)) {
+		return false, "502 Too Many Locations"
+	}
+	userConnections[user]++
+	if group != nil {
+		groupConnections[group.GroupName]++
+		s.connectionGroup = group.GroupName
+	}
+	s.commandLimiter = userCommandLimiter(user, elem.MaxCommandsPerSec, elem.MaxCommandBurst)
+	s.maxCommands = elem.MaxConcurrentCommands
+	s.maxPostConns = elem.MaxPostConnections
+	if elem.MaxBytesPerSec > 0 {
+		s.clientWriter.setRate(elem.MaxBytesPerSec)
+	}
+	if s.certPolicy == nil {
+		s.policy = cfg.FindPolicy(elem.Policy)
+	}
+	return true, ""
+}
+
+// releaseAuthorization undoes the connection accounting of a successful
+// handleAuthorization when no backend session could be set up for the user.
+func (s *session) releaseAuthorization(user string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	releaseUserConnLocked(user)
+	untrackUserIPLocked(user, clientIP(s.UserConnection))
+	if s.connectionGroup != "" {
+		groupConnections[s.connectionGroup]--
+		s.connectionGroup = ""
+	}
+}
+
+// handleBackendHint stores the backend requested via the non-standard
+// XBACKEND command, to be preferred by the selector on AUTHINFO.
+func (s *session) handleBackendHint(args []string) {
+	t := s.client
+
+	if s.backendConnection != nil {
+		t.PrintfLine("502 backend already selected")
+		return
+	}
+
+	if len(args) != 1 {
+		t.PrintfLine("501 Syntax: XBACKEND name")
+		return
+	}
+
+	if !findBackend(args[0]) {
+		t.PrintfLine("502 unknown backend")
+		return
+	}
+
+	s.backendHint = args[0]
+	t.PrintfLine("250 backend hint accepted")
+}
+
+// parseAuthinfoPass returns the password of an AUTHINFO PASS line. The
+// keywords may be separated by runs of spaces or tabs; everything after the
+// whitespace following PASS is the password, embedded spaces included.
+func parseAuthinfoPass(line string) (string, bool) {
+	rest, ok := cutKeyword(line, "authinfo")
+	if !ok {
+		return "", false
+	}
+	password, ok := cutKeyword(rest, "pass")
+	if !ok || password == "" {
+		return "", false
+	}
+	return password, true
+}
+
+// cutKeyword removes keyword, in any case, and the whitespace around it from
+// the start of s. It reports false if s does not start with the keyword
+// followed by whitespace.
+func cutKeyword(s string, keyword string) (string, bool) {
+	s = strings.TrimLeft(s, " \t")
+	if len(s) <= len(keyword) || !strings.EqualFold(s[:len(keyword)], keyword) {
+		return "", false
+	}
+	if s[len(keyword)] != ' ' && s[len(keyword)] != '\t' {
+		return "", false
+	}
+	return strings.TrimLeft(s[len(keyword):], " \t"), true
+}
+
+func (s *session) handleAuth(args []string) {
+	t := s.client
+
+	if inMaintenance() {
+		message := cfg.Frontend.FrontendMaintenanceMessage
+		if message == "" {
+			message = "server in maintenance mode"
+		}
+		t.PrintfLine("400 %s", message)
+		return
+	}
+
+	if window := activeMaintenanceWindow(); window != "" {
+		log.Printf("[CONN] Refusing login during maintenance window %v", window)
+		t.PrintfLine("400 maintenance window")
+		return
+	}
+
+	if _, secure := s.UserConnection.(*tls.Conn); !secure && cfg.Frontend.FrontendRequireSecureAuth {
+		t.PrintfLine("483 Secure connection required")
+		return
+	}
+
+	if len(args) < 2 {
+		t.PrintfLine("502 Unknown Syntax!")
+		return
+	}
+
+	if strings.ToLower(args[0]) != "user" {
 		t.PrintfLine("502 Unknown Syntax!")
 		return
 	}
 
-	success, message := s.handleAuthorization(args[1], parts[2])
+	t.PrintfLine("381 Continue")
+
+	a, err := t.ReadLine()
+	if err != nil {
+		return
+	}
+	password, ok := parseAuthinfoPass(a)
+	if !ok {
+		t.PrintfLine("502 Unknown Syntax!")
+		return
+	}
+
+	success, message := s.handleAuthorization(args[1], password)
 	if !success {
-		t.PrintfLine(message)
+		t.PrintfLine("%s", message)
 		return
 	}
 
-	selectedBackend := &config.SelectedBackend{}
-	for _, elem := range cfg.Backend {
+	// Backends that refuse the connection or the login are skipped in favour
+	// of the next eligible one.
+	var selectedBackend *config.SelectedBackend
+	var conn net.Conn
+	var c *textproto.Conn
+	var pc *pooledConn
+	failed := map[string]bool{}
+	authFailed, certMismatch := false, false
+	for {
+		var unhealthy []string
+		var eligible int
+		selectedBackend, pc, unhealthy, eligible = selectBackend(s.backendHint, s.backendGroup, s.policy, failed)
+
+		if len(selectedBackend.BackendAddr) == 0 && len(selectedBackend.BackendPort) == 0 {
+			s.releaseAuthorization(args[1])
+			if certMismatch {
+				t.PrintfLine("502 Backend certificate mismatch")
+				return
+			}
+			if authFailed {
+				t.PrintfLine("502 Backend AUTH Failed!")
+				return
+			}
+			if len(failed) > 0 {
+				t.PrintfLine("502 Backend Unavailable")
+				return
+			}
+			if len(unhealthy) > 0 && len(unhealthy) == eligible {
+				log.Printf("[CONN] No healthy backend for %v, unhealthy: %v", args[1], strings.Join(unhealthy, ", "))
+				t.PrintfLine("400 no healthy backend available for your account")
+				return
+			}
+			t.PrintfLine("502 NO free backend connection!")
+			return
+		}
+
+		if pc != nil {
+			err := probeIdleConn(pc, "")
+			if err != nil {
+				log.Printf("[HEALTH] Recycling idle connection to %v: %v", selectedBackend.BackendName, err)
+				discardPooledConn(pc)
+				continue
+			}
+			// Pooled connections never carry a client IP, see releaseToPool.
+			if selectedBackend.BackendForwardClientIPCommand != "" {
+				forwardClientIP(pc.c, selectedBackend, clientIP(s.UserConnection))
+			}
+			conn, c, s.backendCompressed = pc.conn, pc.c, pc.compressed
+			break
+		}
 
-		if backendConnections[elem.BackendName] < elem.BackendConns {
-			selectedBackend.BackendName = elem.BackendName
-			selectedBackend.BackendAddr = elem.BackendAddr
-			selectedBackend.BackendPort = elem.BackendPort
-			selectedBackend.BackendTLS = elem.BackendTLS
-			selectedBackend.BackendUser = elem.BackendUser
-			selectedBackend.BackendPass = elem.BackendPass
+		releaseDialSlot := acquireDialSlot(selectedBackend.BackendName)
 
-			backendConnections[elem.BackendName] += 1
+		var timing dialTiming
+		var err error
+		conn, timing, err = dialBackendTimed(selectedBackend, 0)
+		if err != nil {
+			releaseDialSlot()
+			markBackendFailed(selectedBackend.BackendName)
+			log.Printf("[CONN] Dialing Backend %v (%v:%v) failed: %v", selectedBackend.BackendName, selectedBackend.BackendAddr, selectedBackend.BackendPort, err)
+			mu.Lock()
+			releaseBackendLocked(selectedBackend)
+			mu.Unlock()
+			failed[selectedBackend.BackendName] = true
+			certMismatch = certMismatch || errors.Is(err, errCertMismatch)
+			continue
+		}
+
+		authStart := time.Now()
+		conn, c, err = authenticateBackend(conn, selectedBackend)
+		releaseDialSlot()
+		debugf("Backend %v for %v: dns %v, connect %v, tls %v, auth %v", selectedBackend.BackendName, args[1],
+			timing.dns.Round(time.Microsecond), timing.connect.Round(time.Microsecond), timing.tls.Round(time.Microsecond), time.Since(authStart).Round(time.Microsecond))
+
+		if err == nil && selectedBackend.BackendForwardClientIPCommand != "" {
+			forwardClientIP(c, selectedBackend, clientIP(s.UserConnection))
+		}
+
+		if err == nil && selectedBackend.BackendCompress {
+			s.backendCompressed = enableCompression(c, selectedBackend)
+		}
+
+		if err == nil && selectedBackend.BackendAutoModeReader {
+			err = sendModeReader(c)
+		}
+
+		if err == nil {
 			break
+		}
+
+		log.Printf("[CONN] Login to Backend %v failed: %v", selectedBackend.BackendName, err)
+		markBackendFailed(selectedBackend.BackendName)
+		conn.Close()
+		mu.Lock()
+		releaseBackendLocked(selectedBackend)
+		mu.Unlock()
+		s.backendCompressed = false
+		failed[selectedBackend.BackendName] = true
+		if errors.Is(err, errCertMismatch) {
+			certMismatch = true
 		} else {
+			authFailed = true
+		}
+	}
+
+	markBackendHealthy(selectedBackend.BackendName)
+	audit("login", args[1], clientIP(s.UserConnection), "backend="+selectedBackend.BackendName+" security="+s.security)
+	t.PrintfLine("281 %s", welcomeLine())
+	s.backendConnection = conn
+	s.backend = c
+	s.selectedBackend = selectedBackend
+	s.username = args[1]
+	s.modeReaderPending = selectedBackend.BackendRequireModeReader && !selectedBackend.BackendAutoModeReader
+	s.backendSince = time.Now()
+	s.backendAcquired = s.backendSince
+	if pc != nil {
+		// Pooled connections are already in reader mode.
+		s.modeReaderPending = false
+		s.backendSince = pc.created
+		log.Printf("[CONN] Reusing pooled Backend Connection: %v", selectedBackend.BackendName)
+	} else if s.fingerprint != "" {
+		log.Printf("[CONN] Connecting to Backend: %v (user %v, fingerprint %v)", selectedBackend.BackendName, s.username, s.fingerprint)
+	} else {
+		log.Printf("[CONN] Connecting to Backend: %v", selectedBackend.BackendName)
+	}
+}
+
+// selectBackend reserves a connection slot on the first healthy backend with
+// free capacity, preferring the backend named by hint if it has room. It
+// also returns the names of the backends skipped as unhealthy and the number
+// of backends the session may use at all, healthy or not. A non-empty
+// group limits the choice to the backends of that group, and policy to the
+// backends it allows. Backends in exclude are skipped. With
+// FrontendPoolSessions an idle pooled connection to the chosen backend is
+// returned instead of a new slot when there is one.
+func selectBackend(hint string, group string, policy *config.Policy, exclude map[string]bool) (*config.SelectedBackend, *pooledConn, []string, int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	unhealthy := []string{}
+	eligible := 0
+	for _, elem := range cfg.Backend {
+		if (group != "" && elem.BackendGroup != group) || !policy.AllowsBackend(elem.BackendName) {
 			continue
 		}
+		eligible++
+		if backendUnhealthy[elem.BackendName] {
+			unhealthy = append(unhealthy, elem.BackendName)
+		}
 	}
 
-	if len(selectedBackend.BackendAddr) == 0 && len(selectedBackend.BackendPort) == 0 {
-		t.PrintfLine("502 NO free backend connection!")
-		return
+	tiered := false
+	for _, elem := range cfg.Backend {
+		if elem.BackendPriority != 0 {
+			tiered = true
+		}
 	}
 
+	for pass := 0; pass < 2; pass++ {
+		// With round-robin, start scanning after the backend picked last.
+		start := 0
+		if cfg.Frontend.FrontendBackendStrategy == "roundrobin" {
+			start = selectCursor
+		}
+
+		candidates := []int{}
+		for k := range cfg.Backend {
+			i := (start + k) % len(cfg.Backend)
+			elem := cfg.Backend[i]
+
+			if pass == 0 && strings.ToLower(elem.BackendName) != strings.ToLower(hint) {
+				continue
+			}
+
+			if group != "" && elem.BackendGroup != group {
+				continue
+			}
+
+			if !policy.AllowsBackend(elem.BackendName) || exclude[elem.BackendName] {
+				continue
+			}
+
+			if backendUnhealthy[elem.BackendName] || quotaExhausted(elem.BackendName) {
+				continue
+			}
+
+			// Idle pooled connections give way to sessions.
+			if !backendHasRoomLocked(i) && len(idleConns[elem.BackendName]) == 0 {
+				continue
+			}
+
+			candidates = append(candidates, i)
+		}
+
+		if len(candidates) == 0 {
+			continue
+		}
+
+		best := pickBackendLocked(candidates)
+		if tiered {
+			log.Printf("[CONN] Selected tier %v backend %v", cfg.Backend[best].BackendPriority, cfg.Backend[best].BackendName)
+		}
+		selectCursor = best + 1
+		if cfg.Frontend.FrontendPoolSessions {
+			if pc := takeIdleConnLocked(cfg.Backend[best].BackendName); pc != nil {
+				return pc.backend, pc, unhealthy, eligible
+			}
+		}
+		if !backendHasRoomLocked(best) {
+			evictIdleConnLocked(cfg.Backend[best].BackendName)
+		}
+		if selectedBackend := reserveBackendLocked(best); selectedBackend != nil {
+			return selectedBackend, nil, unhealthy, eligible
+		}
+		break
+	}
+
+	return &config.SelectedBackend{}, nil, unhealthy, eligible
+}
+
+// pickBackendLocked chooses among the indexes of cfg.Backend with free
+// slots, given in scan order, according to FrontendBackendStrategy. The tier
+// with the lowest BackendPriority is always preferred, and within it backends
+// whose last failure is the most recent are only used when no other is left.
+// Must be called with mu held.
+func pickBackendLocked(candidates []int) int {
+	// Only the tier with the lowest priority number is considered.
+	tier := cfg.Backend[candidates[0]].BackendPriority
+	for _, i := range candidates {
+		if cfg.Backend[i].BackendPriority < tier {
+			tier = cfg.Backend[i].BackendPriority
+		}
+	}
+	inTier := []int{}
+	for _, i := range candidates {
+		if cfg.Backend[i].BackendPriority == tier {
+			inTier = append(inTier, i)
+		}
+	}
+
+	lowest := -1.0
+	preferred := []int{}
+	for _, i := range inTier {
+		penalty := failurePenalty(cfg.Backend[i].BackendName, cfg.Backend[i].BackendFailurePenaltyDuration)
+		if lowest < 0 || penalty < lowest {
+			lowest = penalty
+			preferred = preferred[:0]
+		}
+		if penalty == lowest {
+			preferred = append(preferred, i)
+		}
+	}
+
+	switch cfg.Frontend.FrontendBackendStrategy {
+	case "leastconn":
+		return pickLeastConn(cfg.Backend, backendConnections, preferred)
+	case "weighted":
+		return pickWeightedLocked(preferred)
+	case "lowestlatency":
+		return pickFastestLocked(preferred)
+	}
+	return preferred[0]
+}
+
+// selectWeights holds the running weights of the smooth weighted
+// round-robin. Guarded by mu.
+var selectWeights = make(map[string]int)
+
+// pickWeightedLocked spreads selections over the candidates in proportion to
+// their BackendWeight. Backends with weight 0 are only picked when no
+// weighted backend is left. Must be called with mu held.
+func pickWeightedLocked(candidates []int) int {
+	best, total := -1, 0
+	for _, i := range candidates {
+		elem := cfg.Backend[i]
+		if elem.BackendWeight <= 0 {
+			continue
+		}
+		selectWeights[elem.BackendName] += elem.BackendWeight
+		total += elem.BackendWeight
+		if best == -1 || selectWeights[elem.BackendName] > selectWeights[cfg.Backend[best].BackendName] {
+			best = i
+		}
+	}
+
+	if best == -1 {
+		return candidates[0]
+	}
+	selectWeights[cfg.Backend[best].BackendName] -= total
+	return best
+}
+
+// pickLeastConn returns the candidate, an index into backends, with the
+// lowest share of its slots in use according to counts. Ties go to the
+// earliest candidate, which is config order.
+func pickLeastConn(backends []config.BackendConfig, counts map[string]int, candidates []int) int {
+	best, bestUsage := -1, 0.0
+	for _, i := range candidates {
+		usage := 1.0
+		if backends[i].BackendConns > 0 {
+			usage = float64(counts[backends[i].BackendName]) / float64(backends[i].BackendConns)
+		}
+		if best == -1 || usage < bestUsage {
+			best, bestUsage = i, usage
+		}
+	}
+	return best
+}
+
+// reserveBackendLocked takes a connection slot and a credential of the
+// backend at index i of cfg.Backend. It returns nil if every credential is at
+// its limit. Must be called with mu held.
+func reserveBackendLocked(i int) *config.SelectedBackend {
+	elem := cfg.Backend[i]
+	credential, ok := pickCredential(elem.BackendName, elem.Credentials())
+	if !ok {
+		return nil
+	}
+	selectedBackend := elem.Selected()
+	selectedBackend.BackendUser = credential.CredentialUser
+	selectedBackend.BackendPass = credential.CredentialPass
+
+	backendConnections[elem.BackendName] += 1
+	credentialConnections[credentialKey(elem.BackendName, credential.CredentialUser)] += 1
+	return selectedBackend
+}
+
+// dialBackend opens a plain or TLS connection to the backend. A zero timeout
+// means no timeout.
+func dialBackend(selectedBackend *config.SelectedBackend, timeout time.Duration) (net.Conn, error) {
+	conn, _, err := dialBackendTimed(selectedBackend, timeout)
+	return conn, err
+}
+
+// dialTiming is how long the phases of a backend connection took.
+type dialTiming struct {
+	dns     time.Duration
+	connect time.Duration
+	tls     time.Duration
+}
+
+// dialBackendTimed is dialBackend, also measuring name resolution, the TCP
+// connect and the TLS handshake separately.
+func dialBackendTimed(selectedBackend *config.SelectedBackend, timeout time.Duration) (net.Conn, dialTiming, error) {
+	var timing dialTiming
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupHost(context.Background(), selectedBackend.BackendAddr)
+	timing.dns = time.Since(start)
+	if err != nil {
+		return nil, timing, err
+	}
+
+	// New backend connection to upstream NNTP
+	start = time.Now()
+	dialer := &net.Dialer{Deadline: deadline}
 	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(ip, selectedBackend.BackendPort))
+		if err == nil {
+			break
+		}
+	}
+	timing.connect = time.Since(start)
+	if err != nil {
+		return nil, timing, err
+	}
+
+	if !selectedBackend.BackendTLS {
+		return conn, timing, nil
+	}
+
+	start = time.Now()
+	tlsConn := tls.Client(conn, backendTLSConfig(selectedBackend))
+	conn.SetDeadline(deadline)
+	err = tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	timing.tls = time.Since(start)
+	if err != nil {
+		conn.Close()
+		return nil, timing, err
+	}
+	return tlsConn, timing, nil
+}
+
+// backendTLSConfig returns the TLS settings for connections to the backend,
+// used both for implicit TLS and for STARTTLS. The certificate is verified
+// against BackendServerName, or the dial address if it is not set, unless
+// BackendInsecureSkipVerify is set. A BackendPinnedCertSHA256 is checked
+// either way.
+func backendTLSConfig(selectedBackend *config.SelectedBackend) *tls.Config {
+	serverName := selectedBackend.BackendServerName
+	if serverName == "" {
+		serverName = selectedBackend.BackendAddr
+	}
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: selectedBackend.BackendInsecureSkipVerify,
+	}
+	if selectedBackend.BackendPinnedCertSHA256 != "" {
+		tlsConf.VerifyPeerCertificate = verifyPinnedCert(selectedBackend.BackendPinnedCertSHA256)
+	}
+	return tlsConf
+}
+
+// authenticateBackend reads the backend greeting, upgrades the connection
+// with STARTTLS if the backend requires it, and logs in with the backend
+// credentials. It returns the connection to use from then on.
+func authenticateBackend(conn net.Conn, selectedBackend *config.SelectedBackend) (net.Conn, *textproto.Conn, error) {
+	c := textproto.NewConn(conn)
+
+	_, _, err := c.ReadCodeLine(200)
+	if err != nil {
+		return conn, c, err
+	}
+
+	return loginBackend(conn, c, selectedBackend)
+}
+
+// loginBackend continues authenticateBackend after the greeting was read.
+func loginBackend(conn net.Conn, c *textproto.Conn, selectedBackend *config.SelectedBackend) (net.Conn, *textproto.Conn, error) {
 	var err error
+	if selectedBackend.BackendStartTLS {
+		conn, c, err = startBackendTLS(conn, c, selectedBackend)
+		if err != nil {
+			return conn, c, err
+		}
+	}
+
+	err = c.PrintfLine("authinfo user %s", selectedBackend.BackendUser)
+	if err != nil {
+		return conn, c, err
+	}
 
-	if selectedBackend.BackendTLS {
+	code, _, err := c.ReadCodeLine(381)
+	if _, secure := conn.(*tls.Conn); code == 483 && !secure {
+		// The backend wants encryption before the credentials; nothing
+		// secret has been sent yet.
+		log.Printf("[CONN] Backend %v requires a secure connection for AUTHINFO, upgrading with STARTTLS", selectedBackend.BackendName)
+		conn, c, err = startBackendTLS(conn, c, selectedBackend)
+		if err != nil {
+			return conn, c, err
+		}
 
-		conf := &tls.Config{
-			InsecureSkipVerify: true,
+		err = c.PrintfLine("authinfo user %s", selectedBackend.BackendUser)
+		if err != nil {
+			return conn, c, err
 		}
+		_, _, err = c.ReadCodeLine(381)
+	}
+	if err != nil {
+		return conn, c, err
+	}
+
+	err = c.PrintfLine("authinfo pass %s", selectedBackend.BackendPass)
+	if err != nil {
+		return conn, c, err
+	}
+
+	_, _, err = c.ReadCodeLine(281)
+	return conn, c, err
+}
+
+// startBackendTLS upgrades a plaintext backend connection with STARTTLS.
+// A refusal is returned as an error rather than sending the credentials in
+// the clear.
+func startBackendTLS(conn net.Conn, c *textproto.Conn, selectedBackend *config.SelectedBackend) (net.Conn, *textproto.Conn, error) {
+	err := c.PrintfLine("STARTTLS")
+	if err != nil {
+		return conn, c, err
+	}
+
+	_, _, err = c.ReadCodeLine(382)
+	if err != nil {
+		return conn, c, fmt.Errorf("backend %v refused STARTTLS: %v", selectedBackend.BackendName, err)
+	}
+
+	tlsConn := tls.Client(conn, backendTLSConfig(selectedBackend))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return conn, c, err
+	}
 
-		conn, err = tls.Dial("tcp", selectedBackend.BackendAddr+":"+selectedBackend.BackendPort, conf)
+	return tlsConn, textproto.NewConn(tlsConn), nil
+}
+
+// errSlowBackend reports that the backend did not start answering a command
+// within its BackendMaxResponseTime. Nothing has been sent to the client.
+var errSlowBackend = errors.New("backend response time exceeded")
 
+// failoverSlowBackend retries the current command on another backend after
+// slowBackend timed out. The session's own connection has an unanswered
+// command pending, so it is replaced first.
+func (s *session) failoverSlowBackend(verb string, slowBackend string) (string, error) {
+	log.Printf("[RELAY] Backend %v too slow for %v, failing over", slowBackend, verb)
+	penalizeBackend(slowBackend)
+
+	if !s.relayedPooled {
+		err := s.renewBackendConn()
 		if err != nil {
-			log.Printf("%v", err)
-			log.Printf("%v:%v", selectedBackend.BackendAddr, selectedBackend.BackendPort)
-			return
+			return slowBackend, err
 		}
+	}
 
-	} else {
-		// New backend connection to upstream NNTP
-		conn, err = net.Dial("tcp", selectedBackend.BackendAddr+":"+selectedBackend.BackendPort)
+	pc, err := borrowPooledConn(s.backendGroup, s.policy, slowBackend)
+	if err != nil {
+		log.Printf("[RELAY] No backend to fail over to from %v: %v", slowBackend, err)
+		s.client.PrintfLine("403 Backend response timed out")
+		return slowBackend, nil
+	}
 
+	_, err = s.relayOn(pc, verb)
+	if err == errSlowBackend {
+		penalizeBackend(pc.backend.BackendName)
+		s.client.PrintfLine("403 Backend response timed out")
+		return pc.backend.BackendName, nil
+	}
+	return pc.backend.BackendName, err
+}
+
+// renewBackendConn replaces the session's backend connection once its lease
+// has expired. It runs between commands, keeps the backend slot and
+// credential, and restores reader mode and the selected group.
+func (s *session) renewBackendConn() error {
+	selectedBackend := s.selectedBackend
+
+	s.backendConnection.Close()
+
+	releaseDialSlot := acquireDialSlot(selectedBackend.BackendName)
+	conn, err := dialBackend(selectedBackend, 0)
+	if err != nil {
+		releaseDialSlot()
+		return err
+	}
+
+	conn, c, err := authenticateBackend(conn, selectedBackend)
+	releaseDialSlot()
+	s.backendConnection = conn
+	s.backend = c
+	if err != nil {
+		return err
+	}
+
+	if selectedBackend.BackendForwardClientIPCommand != "" {
+		forwardClientIP(c, selectedBackend, clientIP(s.UserConnection))
+	}
+
+	s.backendCompressed = false
+	if selectedBackend.BackendCompress {
+		s.backendCompressed = enableCompression(c, selectedBackend)
+	}
+
+	if selectedBackend.BackendAutoModeReader || (selectedBackend.BackendRequireModeReader && !s.modeReaderPending) {
+		err = sendModeReader(c)
 		if err != nil {
-			log.Printf("%v", err)
-			log.Printf("%v:%v", selectedBackend.BackendAddr, selectedBackend.BackendPort)
-			return
+			return err
 		}
 	}
 
-	c := textproto.NewConn(conn)
+	if s.lastGroup != "" {
+		err = c.PrintfLine("GROUP %s", s.lastGroup)
+		if err != nil {
+			return err
+		}
+		_, _, err = c.ReadCodeLine(211)
+		if err != nil {
+			return err
+		}
+	}
 
-	_, _, err = c.ReadCodeLine(200)
+	s.backendSince = time.Now()
+	log.Printf("[CONN] Renewed connection to Backend %v for %v", selectedBackend.BackendName, s.username)
+	return nil
+}
+
+// retryInReaderMode switches the backend to reader mode after it answered
+// the current command with the 401 line, and sends the command again. It
+// returns the new response line, or line itself if the backend refuses to
+// switch.
+func (s *session) retryInReaderMode(line string) (string, error) {
+	log.Printf("[RELAY] Backend %v answered %q, sending MODE READER and retrying", s.selectedBackend.BackendName, line)
+
+	err := sendModeReader(s.backend)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		log.Printf("[RELAY] Backend %v: %v", s.selectedBackend.BackendName, err)
+		return line, nil
+	}
 	if err != nil {
-		return
+		return "", err
 	}
+	s.modeReaderPending = false
 
-	err = c.PrintfLine("authinfo user %s", selectedBackend.BackendUser)
+	err = s.backend.PrintfLine("%s", s.command)
+	if err != nil {
+		return "", err
+	}
+	return s.backend.ReadLine()
+}
 
+// sendModeReader switches the backend to reader mode.
+func sendModeReader(c *textproto.Conn) error {
+	err := c.PrintfLine("MODE READER")
 	if err != nil {
-		return
+		return err
 	}
 
-	_, _, err = c.ReadCodeLine(381)
+	_, _, err = c.ReadResponse(2)
 	if err != nil {
-		return
+		return fmt.Errorf("MODE READER failed: %w", err)
 	}
+	return nil
+}
 
-	err = c.PrintfLine("authinfo pass %s", selectedBackend.BackendPass)
+// forwardClientIP announces the originating client address to the backend.
+// Backends rejecting the command are tolerated.
+func forwardClientIP(c *textproto.Conn, selectedBackend *config.SelectedBackend, ip string) {
+	err := c.PrintfLine("%s %s", selectedBackend.BackendForwardClientIPCommand, ip)
 	if err != nil {
+		log.Printf("[CONN] Forwarding client IP to %v failed: %v", selectedBackend.BackendName, err)
 		return
 	}
-	_, _, err = c.ReadCodeLine(281)
 
-	if err == nil {
-		t.PrintfLine("281 Welcome")
-		s.backendConnection = conn
-		s.selectedBackend = selectedBackend
-		s.username = args[1]
-		log.Printf("[CONN] Connecting to Backend: %v", selectedBackend.BackendName)
+	_, _, err = c.ReadCodeLine(2)
+	if err != nil {
+		log.Printf("[CONN] Backend %v rejected client IP forwarding: %v", selectedBackend.BackendName, err)
+	}
+}
 
-		return
-	} else {
-		log.Printf("%v", err)
-		backendConnections[selectedBackend.BackendName] -= 1
-		t.PrintfLine("502 Backend AUTH Failed!")
-		return
+// enableCompression asks the backend to compress multi-line responses.
+// It reports false, leaving the connection uncompressed, if the backend
+// refuses.
+func enableCompression(c *textproto.Conn, selectedBackend *config.SelectedBackend) bool {
+	err := c.PrintfLine("XFEATURE COMPRESS GZIP TERMINATOR")
+	if err != nil {
+		log.Printf("[CONN] Enabling compression on %v failed: %v", selectedBackend.BackendName, err)
+		return false
+	}
+
+	_, _, err = c.ReadCodeLine(290)
+	if err != nil {
+		log.Printf("[CONN] Backend %v refused compression: %v", selectedBackend.BackendName, err)
+		return false
+	}
+
+	return true
+}
+
+// closeClient flushes any buffered output to the client and sends a final
+// status line before closing the connection, giving up once the drain
+// timeout has passed.
+func (s *session) closeClient(status string) {
+	drain := defaultCloseDrainTimeout
+	if cfg.Frontend.FrontendCloseDrainTimeout > 0 {
+		drain = time.Duration(cfg.Frontend.FrontendCloseDrainTimeout) * time.Second
+	}
+
+	s.clientWriter.stop()
+	s.UserConnection.SetWriteDeadline(time.Now().Add(drain))
+	if s.client.W.Flush() == nil {
+		s.client.PrintfLine("%s", status)
+	}
+	s.UserConnection.Close()
+}
+
+// refuseConnection sends status to a client that is not served and closes
+// the connection.
+func refuseConnection(conn net.Conn, status string) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "%s\r\n", status)
+	conn.Close()
+}
+
+// isDisconnect reports whether a read error means the client went away, as
+// opposed to sending something the proxy could not read.
+func isDisconnect(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// logf logs for the session. Before authentication only sampled sessions
+// are logged, see FrontendLogSampleRate.
+func (s *session) logf(format string, v ...interface{}) {
+	if s.username != "" || s.logSampled {
+		log.Printf(format, v...)
 	}
 }
 
 // Handles incoming requests.
-func handleRequest(conn net.Conn) {
+func handleRequest(conn net.Conn, backendGroup string) {
+	if !clientNetworkAllowed(clientIP(conn)) {
+		debugf("Refusing client %v from a denied network", clientIP(conn))
+		refuseConnection(conn, "502 Access denied")
+		return
+	}
 
-	c := textproto.NewConn(conn)
+	if !acquireIPConn(clientIP(conn)) {
+		log.Printf("[CONN] Refusing client %v: too many connections", clientIP(conn))
+		refuseConnection(conn, "502 Too many connections from your IP")
+		return
+	}
+
+	// A lingering connection keeps its slots until it is closed, after the
+	// handler has returned.
+	lingering := false
+	defer func() {
+		if !lingering {
+			releaseIPConn(clientIP(conn))
+		}
+	}()
+
+	writer := newClientWriter(conn)
+	c := textproto.NewConn(writer)
 
 	sess := &session{
 		UserConnection:    conn,
+		clientWriter:      writer,
 		backendConnection: nil,
+		client:            c,
 		command:           "",
 		selectedBackend:   nil,
 		username:          "",
+		backendGroup:      backendGroup,
+	}
+
+	if cfg.Frontend.FrontendMaxConcurrentFetchesPerSession > 0 {
+		sess.fetchSlots = make(chan struct{}, cfg.Frontend.FrontendMaxConcurrentFetchesPerSession)
+	}
+
+	sess.logSampled = sampleConnectionLog()
+	sess.metrics.start = time.Now()
+
+	defer func() {
+		if !lingering {
+			sessionEnded()
+		}
+	}()
+	emitEvent("session-start", "", clientIP(conn), "")
+	defer func() {
+		emitEvent("session-end", sess.username, clientIP(conn), "")
+	}()
+	defer func() {
+		if sess.username == "" {
+			unauthenticatedEnded(sess.logSampled)
+		}
+	}()
+
+	if shouldSignalBusy(clientIP(conn)) {
+		message := cfg.Frontend.FrontendBusyMessage
+		if message == "" {
+			message = "server busy, slow down"
+		}
+		sess.logf("[CONN] Client %v reconnects too often while busy", clientIP(conn))
+		sess.closeClient("400 " + message)
+		return
 	}
 
 	c.PrintfLine("200 Welcome to NNTP Proxy!")
 
+	sess.security = connectionSecurity(conn)
+	sess.logf("[CONN] Client %v connected (%v)", clientIP(conn), sess.security)
+
+	if cfg.Frontend.FrontendLogClientFingerprint {
+		sess.fingerprint = clientFingerprint(conn)
+		if sess.fingerprint != "" {
+			sess.logf("[CONN] Client %v fingerprint %v", clientIP(conn), sess.fingerprint)
+		} else {
+			sess.logf("[CONN] Client %v has no TLS fingerprint", clientIP(conn))
+		}
+	}
+
+	if certPoliciesEnabled() {
+		sess.certPolicy = certPolicy(conn)
+		if sess.certPolicy != nil {
+			sess.policy = sess.certPolicy
+			sess.logf("[CONN] Client %v certificate policy %v", clientIP(conn), sess.certPolicy.PolicyName)
+		}
+	}
+
+	// The session limit only cuts short the wait for the next command. POST,
+	// IHAVE and TAKETHIS read the article from the client while relaying, so
+	// a deadline set in the middle of a command would truncate the upload.
+	var sessionEnd time.Time
+	if cfg.Frontend.FrontendMaxSessionDuration > 0 {
+		sessionEnd = time.Now().Add(time.Duration(cfg.Frontend.FrontendMaxSessionDuration) * time.Second)
+	}
+
 	for {
+		var idleDeadline time.Time
+		if cfg.Frontend.FrontendIdleTimeout > 0 {
+			idleDeadline = time.Now().Add(time.Duration(cfg.Frontend.FrontendIdleTimeout) * time.Second)
+			conn.SetReadDeadline(idleDeadline)
+		}
+		capped := !sessionEnd.IsZero() && (idleDeadline.IsZero() || sessionEnd.Before(idleDeadline))
+		if capped {
+			conn.SetReadDeadline(sessionEnd)
+		}
+
 		l, err := c.ReadLine()
+		if err == nil && capped {
+			conn.SetReadDeadline(idleDeadline)
+		}
 		if err != nil {
+			var netErr net.Error
+			if capped && errors.As(err, &netErr) && netErr.Timeout() {
+				sess.expired.Store(true)
+			}
+			pooled := sess.releaseToPool()
+
 			mu.Lock()
 			if sess.username != "" {
-				userConnections[sess.username]--
+				sess.stopPostingLocked()
+				releaseUserConnLocked(sess.username)
+				untrackUserIPLocked(sess.username, clientIP(conn))
+				if sess.connectionGroup != "" {
+					groupConnections[sess.connectionGroup]--
+				}
+				audit("logout", sess.username, clientIP(conn), "")
 			}
 			if sess.selectedBackend != nil && len(sess.selectedBackend.BackendName) > 0 {
-				backendConnections[sess.selectedBackend.BackendName] -= 1
-				log.Printf("[CONN] Dropping Backend Connection: %v", sess.selectedBackend.BackendName)
-			} else {
-				log.Printf("[CONN] Error dropping Backend Connection cause selectedBackend is nil")
-				log.Printf("%v", sess)
-				sess.selectedBackend = nil
+				if pooled {
+					log.Printf("[CONN] Returning Backend Connection to pool: %v", sess.selectedBackend.BackendName)
+				} else {
+					releaseBackendLocked(sess.selectedBackend)
+					log.Printf("[CONN] Dropping Backend Connection: %v", sess.selectedBackend.BackendName)
+				}
+				recordHoldLocked(sess.selectedBackend.BackendName, time.Since(sess.backendAcquired))
+				log.Printf("[SESSION] User %v: %v", sess.username, &sess.metrics)
 			}
 			mu.Unlock()
-			conn.Close()
+			if sess.backendConnection != nil && !pooled {
+				sess.backendConnection.Close()
+			}
+
+			status := "400 closing"
+			if sess.expired.Load() {
+				sess.logf("[CONN] Client %v session expired after %vs", clientIP(conn), cfg.Frontend.FrontendMaxSessionDuration)
+				status = "400 Session expired"
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				sess.logf("[CONN] Client %v idle for %vs, closing", clientIP(conn), cfg.Frontend.FrontendIdleTimeout)
+				status = "400 Timeout"
+			} else if !isDisconnect(err) {
+				sess.logf("[CONN] Client %v protocol error: %v", clientIP(conn), err)
+				status = "501 protocol error"
+			} else if sess.username == "" {
+				sess.logf("[CONN] Client %v disconnected before login", clientIP(conn))
+			}
+			if sess.username == "" && cfg.Frontend.FrontendPreAuthLingerDelay > 0 {
+				// Hold unauthenticated connections open for a while without
+				// keeping this goroutine around.
+				lingering = true
+				time.AfterFunc(time.Duration(cfg.Frontend.FrontendPreAuthLingerDelay)*time.Second, func() {
+					ip := clientIP(conn)
+					sess.closeClient(status)
+					sessionEnded()
+					releaseIPConn(ip)
+				})
+				return
+			}
+			sess.closeClient(status)
 			return
 		}
 
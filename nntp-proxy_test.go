@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickLeastConn(t *testing.T) {
+	backends := []config.BackendConfig{
+		{BackendName: "a", BackendConns: 4},
+		{BackendName: "b", BackendConns: 8},
+		{BackendName: "c", BackendConns: 2},
+		{BackendName: "d", BackendConns: 0},
+	}
+
+	tests := []struct {
+		name       string
+		counts     map[string]int
+		candidates []int
+		want       int
+	}{
+		{"lowest share wins", map[string]int{"a": 2, "b": 2, "c": 1}, []int{0, 1, 2}, 1},
+		{"share, not count", map[string]int{"a": 1, "b": 4}, []int{0, 1}, 0},
+		{"idle backends", map[string]int{}, []int{0, 1, 2}, 0},
+		{"tie goes to config order", map[string]int{"a": 2, "b": 4, "c": 1}, []int{0, 1, 2}, 0},
+		{"tie goes to first candidate", map[string]int{"a": 2, "b": 4}, []int{1, 0}, 1},
+		{"no slots counts as full", map[string]int{"a": 3}, []int{3, 0}, 0},
+		{"only candidates", map[string]int{"a": 4, "b": 8}, []int{0, 1}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickLeastConn(backends, tt.counts, tt.candidates)
+			if got != tt.want {
+				t.Errorf("pickLeastConn() = %v (%v), want %v (%v)", got, backends[got].BackendName, tt.want, backends[tt.want].BackendName)
+			}
+		})
+	}
+}
+
+func TestHandleAuthRefusedBackend(t *testing.T) {
+	// A port nothing listens on, so dialing it is refused.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedCfg, savedAuthorizers := cfg, authorizers
+	savedBackends, savedUsers, savedGroups := backendConnections, userConnections, groupConnections
+	defer func() {
+		cfg, authorizers = savedCfg, savedAuthorizers
+		backendConnections, userConnections, groupConnections = savedBackends, savedUsers, savedGroups
+	}()
+
+	// Both backends refuse, so the second one is tried after the first.
+	cfg = config.Configuration{
+		Backend: []config.BackendConfig{
+			{BackendName: "refused1", BackendAddr: "127.0.0.1", BackendPort: port, BackendUser: "u", BackendPass: "p", BackendConns: 2, BackendUnhealthyThreshold: 10},
+			{BackendName: "refused2", BackendAddr: "127.0.0.1", BackendPort: port, BackendUser: "u", BackendPass: "p", BackendConns: 2, BackendUnhealthyThreshold: 10},
+		},
+		Users: []config.User{{Username: "test", Password: string(hash), MaxConnections: 1}},
+	}
+	authorizers = []Authorizer{staticAuthorizer{}}
+	backendConnections = map[string]int{"refused1": 1}
+	userConnections = make(map[string]int)
+	groupConnections = make(map[string]int)
+	credentials := map[string]int{}
+	for _, name := range []string{"refused1", "refused2"} {
+		credentials[name] = credentialConnections[credentialKey(name, "u")]
+	}
+	defer func() {
+		mu.Lock()
+		for _, name := range []string{"refused1", "refused2"} {
+			delete(backendFailures, name)
+			delete(backendLastFailure, name)
+		}
+		mu.Unlock()
+	}()
+
+	proxySide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	s := &session{
+		UserConnection: proxySide,
+		client:         textproto.NewConn(proxySide),
+	}
+	done := make(chan struct{})
+	go func() {
+		s.handleAuth([]string{"USER", "test"})
+		close(done)
+	}()
+
+	client := textproto.NewConn(clientSide)
+	if line, err := client.ReadLine(); err != nil || line != "381 Continue" {
+		t.Fatalf("after AUTHINFO USER got %q, %v, want 381", line, err)
+	}
+	client.PrintfLine("AUTHINFO PASS secret")
+	if line, err := client.ReadLine(); err != nil || line != "502 Backend Unavailable" {
+		t.Errorf("after AUTHINFO PASS got %q, %v, want \"502 Backend Unavailable\"", line, err)
+	}
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := backendConnections["refused1"]; got != 1 {
+		t.Errorf("refused1 has %v connections, want 1", got)
+	}
+	if got := backendConnections["refused2"]; got != 0 {
+		t.Errorf("refused2 has %v connections, want 0", got)
+	}
+	for name, want := range credentials {
+		if got := credentialConnections[credentialKey(name, "u")]; got != want {
+			t.Errorf("credential of %v has %v connections, want %v", name, got, want)
+		}
+	}
+	if got := userConnections["test"]; got != 0 {
+		t.Errorf("user has %v connections, want 0", got)
+	}
+	if got := backendFailures["refused1"] + backendFailures["refused2"]; got != 2 {
+		t.Errorf("%v dials failed, want 2", got)
+	}
+}
+
+func TestParseAuthinfoPass(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		password string
+		ok       bool
+	}{
+		{"plain", "AUTHINFO PASS secret", "secret", true},
+		{"lower case", "authinfo pass secret", "secret", true},
+		{"embedded spaces", "AUTHINFO PASS correct horse battery", "correct horse battery", true},
+		{"extra spaces", "AUTHINFO  PASS   secret", "secret", true},
+		{"tabs", "AUTHINFO\tPASS\tsecret", "secret", true},
+		{"leading space", " AUTHINFO PASS secret", "secret", true},
+		{"missing argument", "AUTHINFO PASS", "", false},
+		{"missing argument with space", "AUTHINFO PASS ", "", false},
+		{"empty line", "", "", false},
+		{"only spaces", "   ", "", false},
+		{"authinfo only", "AUTHINFO", "", false},
+		{"other subcommand", "AUTHINFO USER someone", "", false},
+		{"keyword prefix", "AUTHINFO PASSWORD secret", "", false},
+		{"other command", "PASS secret", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			password, ok := parseAuthinfoPass(tt.line)
+			if password != tt.password || ok != tt.ok {
+				t.Errorf("parseAuthinfoPass(%q) = %q, %v, want %q, %v", tt.line, password, ok, tt.password, tt.ok)
+			}
+		})
+	}
+}
+
+// TestHandleRequestsRelaysInline checks that commands are relayed on the
+// session's own goroutine: relaying many commands starts no copy goroutines,
+// and every response reaches the client in order.
+func TestHandleRequestsRelaysInline(t *testing.T) {
+	const commands = 50
+
+	proxySide, backendSide := net.Pipe()
+	defer proxySide.Close()
+	defer backendSide.Close()
+
+	go func() {
+		r := bufio.NewReader(backendSide)
+		for i := 0; ; i++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			fmt.Fprintf(backendSide, "111 %v\r\n", i)
+		}
+	}()
+
+	var clientOut bytes.Buffer
+	s := &session{
+		backendConnection: proxySide,
+		backend:           textproto.NewConn(proxySide),
+		client:            textproto.NewConn(bufferConn{strings.NewReader(""), &clientOut}),
+		selectedBackend:   &config.SelectedBackend{BackendName: "test"},
+		username:          "test",
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < commands; i++ {
+		s.command = "DATE"
+		s.handleRequests("DATE")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%v goroutines after relaying %v commands, %v before", after, commands, before)
+	}
+
+	want := ""
+	for i := 0; i < commands; i++ {
+		want += fmt.Sprintf("111 %v\r\n", i)
+	}
+	if clientOut.String() != want {
+		t.Errorf("client got %q, want %v responses in order", clientOut.String(), commands)
+	}
+}
+
+func TestDispatchCommandBlankLine(t *testing.T) {
+	for _, command := range []string{"", "   ", "\t"} {
+		t.Run(fmt.Sprintf("%q", command), func(t *testing.T) {
+			proxySide, backendSide := net.Pipe()
+			forwarded := make(chan string, 1)
+			go func() {
+				b, _ := io.ReadAll(backendSide)
+				forwarded <- string(b)
+			}()
+
+			sessionSide, clientSide := net.Pipe()
+			defer clientSide.Close()
+			s := &session{
+				UserConnection:    sessionSide,
+				client:            textproto.NewConn(sessionSide),
+				backendConnection: proxySide,
+				backend:           textproto.NewConn(proxySide),
+				selectedBackend:   &config.SelectedBackend{BackendName: "test"},
+				username:          "test",
+				command:           command,
+			}
+
+			_, rejected := rejectedCommandVerbs()
+			go s.dispatchCommand()
+
+			clientSide.SetReadDeadline(time.Now().Add(time.Second))
+			line, err := textproto.NewConn(clientSide).ReadLine()
+			if err != nil || line != "500 command not recognized" {
+				t.Errorf("client got %q, %v, want \"500 command not recognized\"", line, err)
+			}
+
+			proxySide.Close()
+			if got := <-forwarded; got != "" {
+				t.Errorf("backend got %q, want nothing", got)
+			}
+			if _, after := rejectedCommandVerbs(); !reflect.DeepEqual(after, rejected) {
+				t.Errorf("rejected commands changed from %v to %v", rejected, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// With frontendPerCommandBackend, ARTICLE, BODY, HEAD and STAT by message-id
+// are relayed over a pool of backend connections shared by all sessions,
+// rotating over the backends of the session's group, instead of the
+// session's own backend connection. Message-ids are global, so every backend
+// answers them the same way, except that one backend may lack an article
+// another one has. GROUP and LISTGROUP pin the session to its own backend
+// connection for the rest of the session, so the current group and article
+// number always come from one backend. Pooled connections serve many
+// clients, so the client IP is never forwarded on them.
+//
+// With frontendPoolSessions, sessions also take their backend connection from
+// the pool when one is idle, and hand it back when the client disconnects,
+// saving the dial and login for the next session. A session forwards its
+// client IP on a connection it takes over, which then stays with the session.
+
+const (
+	poolIdleTimeout = 30 * time.Second
+	idleProbeTick   = 5 * time.Second
+)
+
+type pooledConn struct {
+	conn       net.Conn
+	c          *textproto.Conn
+	compressed bool
+	backend    *config.SelectedBackend
+	idleSince  time.Time
+	probedAt   time.Time
+	created    time.Time
+}
+
+var (
+	// idleConns holds the pooled connections not in use per backend, and
+	// poolNext is where the rotation over the backends continues. Guarded
+	// by mu.
+	idleConns = make(map[string][]*pooledConn)
+	poolNext  int
+)
+
+// isPoolableCommand reports whether the command can be served by any
+// backend.
+func isPoolableCommand(verb string, command string) bool {
+	switch verb {
+	case "ARTICLE", "BODY", "HEAD", "STAT":
+		args := strings.Fields(command)
+		return len(args) == 2 && strings.HasPrefix(args[1], "<")
+	}
+	return false
+}
+
+// isArticleFetch reports whether the command transfers an article or part
+// of one.
+func isArticleFetch(verb string) bool {
+	return verb == "ARTICLE" || verb == "BODY" || verb == "HEAD"
+}
+
+// borrowPooledConn returns an idle pooled connection that answers a probe, or
+// opens a new one if the next backend in rotation has room. Only backends of
+// group permitted by policy are used, and the backend named exclude is
+// skipped.
+func borrowPooledConn(group string, policy *config.Policy, exclude string) (*pooledConn, error) {
+	mu.Lock()
+
+	var selectedBackend *config.SelectedBackend
+	for k := 0; k < len(cfg.Backend); k++ {
+		i := (poolNext + k) % len(cfg.Backend)
+		elem := cfg.Backend[i]
+
+		if group != "" && elem.BackendGroup != group {
+			continue
+		}
+
+		if elem.BackendName == exclude || !policy.AllowsBackend(elem.BackendName) || backendUnhealthy[elem.BackendName] || quotaExhausted(elem.BackendName) {
+			continue
+		}
+
+		if pc := takeIdleConnLocked(elem.BackendName); pc != nil {
+			poolNext = i + 1
+			mu.Unlock()
+
+			err := probeIdleConn(pc, "")
+			if err != nil {
+				log.Printf("[HEALTH] Recycling idle connection to %v: %v", elem.BackendName, err)
+				discardPooledConn(pc)
+				return borrowPooledConn(group, policy, exclude)
+			}
+			return pc, nil
+		}
+
+		if backendHasRoomLocked(i) {
+			selectedBackend = reserveBackendLocked(i)
+			poolNext = i + 1
+			break
+		}
+	}
+	mu.Unlock()
+
+	if selectedBackend == nil {
+		return nil, errors.New("no free backend connection")
+	}
+	return openPooledConn(selectedBackend)
+}
+
+// openPooledConn dials and logs in to a backend whose slot is already
+// reserved, releasing the slot on failure.
+func openPooledConn(selectedBackend *config.SelectedBackend) (*pooledConn, error) {
+	releaseDialSlot := acquireDialSlot(selectedBackend.BackendName)
+
+	conn, err := dialBackend(selectedBackend, 0)
+	if err == nil {
+		var c *textproto.Conn
+		conn, c, err = authenticateBackend(conn, selectedBackend)
+		// Pooled connections only serve reader commands.
+		if err == nil && (selectedBackend.BackendAutoModeReader || selectedBackend.BackendRequireModeReader) {
+			err = sendModeReader(c)
+		}
+		if err == nil {
+			releaseDialSlot()
+			markBackendHealthy(selectedBackend.BackendName)
+
+			pc := &pooledConn{conn: conn, c: c, backend: selectedBackend, created: time.Now()}
+			if selectedBackend.BackendCompress {
+				pc.compressed = enableCompression(c, selectedBackend)
+			}
+			return pc, nil
+		}
+		conn.Close()
+	}
+	releaseDialSlot()
+
+	markBackendFailed(selectedBackend.BackendName)
+	mu.Lock()
+	releaseBackendLocked(selectedBackend)
+	mu.Unlock()
+	return nil, err
+}
+
+// returnPooledConn puts a connection back into the pool after a command
+// completed, or closes it if its lease has expired.
+func returnPooledConn(pc *pooledConn) {
+	if pc.backend.BackendConnLeaseTTL > 0 && time.Since(pc.created) > time.Duration(pc.backend.BackendConnLeaseTTL)*time.Second {
+		discardPooledConn(pc)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	pc.idleSince = time.Now()
+	idleConns[pc.backend.BackendName] = append(idleConns[pc.backend.BackendName], pc)
+}
+
+// discardPooledConn closes a broken pooled connection and frees its slot.
+func discardPooledConn(pc *pooledConn) {
+	pc.conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	releaseBackendLocked(pc.backend)
+}
+
+// takeIdleConnLocked removes the most recently used idle connection of the
+// backend from the pool, or returns nil. The connection may have gone stale
+// while idle, so the caller probes it with probeIdleConn once mu is
+// released, before handing it to a session. Must be called with mu held.
+func takeIdleConnLocked(backendName string) *pooledConn {
+	idle := idleConns[backendName]
+	if len(idle) == 0 {
+		return nil
+	}
+
+	pc := idle[len(idle)-1]
+	idleConns[backendName] = idle[:len(idle)-1]
+	return pc
+}
+
+// releaseToPool hands the session's backend connection to the pool once the
+// client is gone, after a probe has confirmed that it is still in sync. It
+// reports whether the pool took over the connection and its slot.
+// Connections that carry the client IP, are not in reader mode, failed
+// during the session or belong to an expired session are not reused, nor
+// are connections with a selected group or in streaming mode, whose state
+// would carry over to the next session.
+func (s *session) releaseToPool() bool {
+	selectedBackend := s.selectedBackend
+	if !cfg.Frontend.FrontendPoolSessions || s.backend == nil || selectedBackend == nil || s.backendBroken || s.expired.Load() {
+		return false
+	}
+	if selectedBackend.BackendForwardClientIPCommand != "" || s.modeReaderPending || s.pinned || s.streaming {
+		return false
+	}
+
+	pc := &pooledConn{conn: s.backendConnection, c: s.backend, compressed: s.backendCompressed, backend: selectedBackend, created: s.backendSince}
+	err := probeIdleConn(pc, "")
+	if err != nil {
+		log.Printf("[CONN] Not pooling Backend Connection to %v: %v", selectedBackend.BackendName, err)
+		return false
+	}
+
+	returnPooledConn(pc)
+	return true
+}
+
+// writePoolUsage renders the idle and in-use connections per backend.
+func writePoolUsage(w io.Writer) {
+	var buf bytes.Buffer
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		idle := len(idleConns[elem.BackendName])
+		fmt.Fprintf(&buf, "pool %v - %v idle / %v in use\n", elem.BackendName, idle, backendConnections[elem.BackendName]-idle)
+	}
+	mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// evictIdleConnLocked closes one idle pooled connection of the backend to
+// make room for a session. Must be called with mu held.
+func evictIdleConnLocked(backendName string) bool {
+	idle := idleConns[backendName]
+	if len(idle) == 0 {
+		return false
+	}
+
+	pc := idle[0]
+	idleConns[backendName] = idle[1:]
+	releaseBackendLocked(pc.backend)
+	go pc.conn.Close()
+	return true
+}
+
+// reapIdleConns closes pooled connections that have not been used for
+// poolIdleTimeout, so idle pools do not hold backend slots forever.
+func reapIdleConns() {
+	for range time.Tick(poolIdleTimeout) {
+		mu.Lock()
+		for name, idle := range idleConns {
+			kept := idle[:0]
+			for _, pc := range idle {
+				if time.Since(pc.idleSince) < poolIdleTimeout {
+					kept = append(kept, pc)
+					continue
+				}
+				releaseBackendLocked(pc.backend)
+				go pc.conn.Close()
+			}
+			idleConns[name] = kept
+		}
+		mu.Unlock()
+	}
+}
+
+// probeIdleConns sends the idle probe command of the backend on pooled
+// connections that have been idle for its probe interval, recycling the ones
+// that do not answer properly.
+func probeIdleConns() {
+	for range time.Tick(idleProbeTick) {
+		for _, elem := range backendsSnapshot() {
+			if elem.BackendIdleProbeInterval <= 0 {
+				continue
+			}
+			interval := time.Duration(elem.BackendIdleProbeInterval) * time.Second
+
+			mu.Lock()
+			due := []*pooledConn{}
+			kept := []*pooledConn{}
+			for _, pc := range idleConns[elem.BackendName] {
+				last := pc.probedAt
+				if pc.idleSince.After(last) {
+					last = pc.idleSince
+				}
+				if time.Since(last) >= interval {
+					due = append(due, pc)
+				} else {
+					kept = append(kept, pc)
+				}
+			}
+			idleConns[elem.BackendName] = kept
+			mu.Unlock()
+
+			for _, pc := range due {
+				err := probeIdleConn(pc, elem.BackendIdleProbeCommand)
+				if err != nil {
+					log.Printf("[HEALTH] Recycling idle connection to %v: %v", elem.BackendName, err)
+					discardPooledConn(pc)
+					continue
+				}
+
+				mu.Lock()
+				pc.probedAt = time.Now()
+				idleConns[elem.BackendName] = append(idleConns[elem.BackendName], pc)
+				mu.Unlock()
+			}
+		}
+	}
+}
+
+// probeIdleConn sends command, DATE by default, and checks that the backend
+// answers with a success code in time.
+func probeIdleConn(pc *pooledConn, command string) error {
+	if command == "" {
+		command = "DATE"
+	}
+
+	pc.conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	defer pc.conn.SetDeadline(time.Time{})
+
+	err := pc.c.PrintfLine("%s", command)
+	if err != nil {
+		return err
+	}
+
+	line, err := pc.c.ReadLine()
+	if err != nil {
+		return err
+	}
+
+	code := responseCode(line)
+	if code < 100 || code >= 400 {
+		return fmt.Errorf("unexpected response to %v: %v", command, line)
+	}
+
+	verb, _, _ := strings.Cut(command, " ")
+	if isMultilineResponse(strings.ToUpper(verb), line) {
+		if pc.compressed {
+			_, err = copyCompressedDataBlock(io.Discard, pc.c.R, nil)
+		} else {
+			_, err = copyDataBlock(io.Discard, pc.c.R, nil)
+		}
+	}
+	return err
+}
+
+// relayPooled relays the current command over a pooled connection, falling
+// back to the session's own backend when the pool has no room or the pooled
+// connection fails before anything reached the client. It returns the name of
+// the backend used.
+func (s *session) relayPooled(verb string) (string, error) {
+	pc, err := borrowPooledConn(s.backendGroup, s.policy, "")
+	if err != nil {
+		log.Printf("[RELAY] Pool unavailable for %v, using session backend: %v", s.username, err)
+		_, err = s.relayCommand(verb)
+		return s.selectedBackend.BackendName, err
+	}
+
+	line, err := s.relayOn(pc, verb)
+	if err != nil && err != errSlowBackend && line == "" {
+		log.Printf("[RELAY] Pooled connection to %v failed, using session backend: %v", pc.backend.BackendName, err)
+		s.relayedPooled = false
+		_, err = s.relayCommand(verb)
+		return s.selectedBackend.BackendName, err
+	}
+	return pc.backend.BackendName, err
+}
+
+// relayOn relays the current command over the pooled connection pc and
+// hands pc back to the pool, or closes it on failure or when the pool is not
+// enabled. It returns the response status line relayed to the client, which
+// is empty if the command failed before the response was relayed.
+func (s *session) relayOn(pc *pooledConn, verb string) (string, error) {
+	s.relayedPooled = true
+
+	conn, backend, compressed, selectedBackend := s.backendConnection, s.backend, s.backendCompressed, s.selectedBackend
+	s.backendConnection, s.backend, s.backendCompressed, s.selectedBackend = pc.conn, pc.c, pc.compressed, pc.backend
+	line, err := s.relayCommand(verb)
+	s.backendConnection, s.backend, s.backendCompressed, s.selectedBackend = conn, backend, compressed, selectedBackend
+
+	if err != nil || !cfg.Frontend.FrontendPerCommandBackend {
+		discardPooledConn(pc)
+	} else {
+		returnPooledConn(pc)
+	}
+	return line, err
+}
@@ -0,0 +1,38 @@
+package main
+
+// Sessions count as reading connections until they issue their first POST or
+// IHAVE, from then on they count as posting connections. Users can limit
+// both kinds separately with maxReadConnections and maxPostConnections, on
+// top of maxConnections.
+
+// postConnections counts the posting sessions per user. Guarded by mu.
+var postConnections = make(map[string]int)
+
+// readConnectionsLocked returns the reading sessions of the user. Must be
+// called with mu held.
+func readConnectionsLocked(user string) int {
+	return userConnections[user] - postConnections[user]
+}
+
+// startPosting turns the session into a posting connection, reporting false
+// if the user has no posting connection left.
+func (s *session) startPosting() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if s.maxPostConns > 0 && postConnections[s.username] >= s.maxPostConns {
+		return false
+	}
+	postConnections[s.username]++
+	s.posting = true
+	return true
+}
+
+// stopPostingLocked releases the posting connection of the session. Must be
+// called with mu held.
+func (s *session) stopPostingLocked() {
+	if s.posting {
+		postConnections[s.username]--
+		s.posting = false
+	}
+}
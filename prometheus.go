@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+var (
+	backendConnectionsDesc    = prometheus.NewDesc("nntp_backend_connections", "Connections in use per backend.", []string{"backend"}, nil)
+	backendMaxConnectionsDesc = prometheus.NewDesc("nntp_backend_max_connections", "Configured connection limit per backend.", []string{"backend"}, nil)
+	userConnectionsDesc       = prometheus.NewDesc("nntp_user_connections", "Logged in connections per user.", []string{"user"}, nil)
+	sessionsActiveDesc        = prometheus.NewDesc("nntp_sessions_active", "Client sessions currently open.", nil, nil)
+	sessionsTotalDesc         = prometheus.NewDesc("nntp_sessions_total", "Client sessions accepted.", nil, nil)
+	authFailuresDesc          = prometheus.NewDesc("nntp_auth_failures_total", "Failed client logins.", nil, nil)
+	eventsDroppedDesc         = prometheus.NewDesc("nntp_events_dropped_total", "Events not delivered to the event socket.", nil, nil)
+	credentialBytesDesc       = prometheus.NewDesc("nntp_credential_bytes_total", "Bytes transferred per backend credential.", []string{"backend", "user"}, nil)
+	commandsRejectedDesc      = prometheus.NewDesc("nntp_commands_rejected_total", "Commands refused per verb.", []string{"verb"}, nil)
+)
+
+// proxyCollector exposes connection and session counters, read at scrape
+// time.
+type proxyCollector struct{}
+
+func (proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendConnectionsDesc
+	ch <- backendMaxConnectionsDesc
+	ch <- userConnectionsDesc
+	ch <- sessionsActiveDesc
+	ch <- sessionsTotalDesc
+	ch <- authFailuresDesc
+	ch <- eventsDroppedDesc
+	ch <- credentialBytesDesc
+	ch <- commandsRejectedDesc
+}
+
+func (proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	// Collected first and sent after mu is released, so a slow scrape does
+	// not hold it up.
+	metrics := []prometheus.Metric{}
+	type credential struct{ backend, user string }
+	credentials := []credential{}
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		metrics = append(metrics,
+			prometheus.MustNewConstMetric(backendConnectionsDesc, prometheus.GaugeValue, float64(backendConnections[elem.BackendName]), elem.BackendName),
+			prometheus.MustNewConstMetric(backendMaxConnectionsDesc, prometheus.GaugeValue, float64(elem.BackendConns), elem.BackendName))
+		for _, cred := range elem.Credentials() {
+			credentials = append(credentials, credential{elem.BackendName, cred.CredentialUser})
+		}
+	}
+	for _, elem := range cfg.Users {
+		metrics = append(metrics, prometheus.MustNewConstMetric(userConnectionsDesc, prometheus.GaugeValue, float64(userConnections[elem.Username]), elem.Username))
+	}
+	mu.Unlock()
+
+	for _, metric := range metrics {
+		ch <- metric
+	}
+
+	ch <- prometheus.MustNewConstMetric(sessionsActiveDesc, prometheus.GaugeValue, float64(activeSessions.Load()))
+	ch <- prometheus.MustNewConstMetric(sessionsTotalDesc, prometheus.CounterValue, float64(totalSessions.Load()))
+	ch <- prometheus.MustNewConstMetric(authFailuresDesc, prometheus.CounterValue, float64(authFailures.Load()))
+	ch <- prometheus.MustNewConstMetric(eventsDroppedDesc, prometheus.CounterValue, float64(eventsDropped.Load()))
+
+	for _, elem := range credentials {
+		ch <- prometheus.MustNewConstMetric(credentialBytesDesc, prometheus.CounterValue, float64(credentialBytesUsed(credentialKey(elem.backend, elem.user))), elem.backend, elem.user)
+	}
+
+	verbs, counts := rejectedCommandVerbs()
+	for _, verb := range verbs {
+		ch <- prometheus.MustNewConstMetric(commandsRejectedDesc, prometheus.CounterValue, float64(counts[verb]), verb)
+	}
+}
+
+// newMetricsHandler serves the proxy's metrics in the Prometheus exposition
+// format. A metric that cannot be gathered, such as a credential listed twice
+// for a backend, is left out instead of failing the whole scrape.
+func newMetricsHandler() http.HandlerFunc {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(proxyCollector{})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).ServeHTTP
+}
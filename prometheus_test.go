@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsHandlerFormat(t *testing.T) {
+	// Label values that need escaping in the text format.
+	const backend, user = `news "main" \1`, "line\nbreak"
+
+	savedCfg := cfg
+	savedBackends, savedUsers := backendConnections, userConnections
+	defer func() {
+		cfg = savedCfg
+		backendConnections, userConnections = savedBackends, savedUsers
+	}()
+	cfg = config.Configuration{
+		Backend: []config.BackendConfig{{BackendName: backend, BackendConns: 4, BackendUser: "u", BackendPass: "p"}},
+		Users:   []config.User{{Username: user}},
+	}
+	backendConnections = map[string]int{backend: 3}
+	userConnections = map[string]int{user: 2}
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler()(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("parsing /metrics: %v", err)
+	}
+
+	for _, name := range []string{
+		"nntp_backend_connections", "nntp_backend_max_connections", "nntp_user_connections",
+		"nntp_sessions_active", "nntp_sessions_total", "nntp_auth_failures_total",
+		"nntp_events_dropped_total", "nntp_credential_bytes_total",
+	} {
+		if families[name] == nil {
+			t.Errorf("/metrics lacks %v", name)
+		}
+	}
+
+	tests := []struct {
+		family string
+		label  string
+		value  string
+		want   float64
+	}{
+		{"nntp_backend_connections", "backend", backend, 3},
+		{"nntp_backend_max_connections", "backend", backend, 4},
+		{"nntp_user_connections", "user", user, 2},
+	}
+	for _, tt := range tests {
+		family := families[tt.family]
+		if family == nil || len(family.GetMetric()) != 1 {
+			t.Errorf("%v: want one series, got %v", tt.family, family)
+			continue
+		}
+		metric := family.GetMetric()[0]
+		if got := metric.GetLabel()[0]; got.GetName() != tt.label || got.GetValue() != tt.value {
+			t.Errorf("%v: label %v=%q, want %v=%q", tt.family, got.GetName(), got.GetValue(), tt.label, tt.value)
+		}
+		if got := metric.GetGauge().GetValue(); got != tt.want {
+			t.Errorf("%v = %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const quotaCheckInterval = 30 * time.Second
+
+type backendQuota struct {
+	Limit     int64     `json:"-"`
+	Used      int64     `json:"used"`
+	NextReset time.Time `json:"nextReset"`
+	schedule  *cronSchedule
+}
+
+var (
+	quotas   = make(map[string]*backendQuota)
+	quotasMu sync.Mutex
+)
+
+// initQuotas sets up byte quotas for backends with BackendQuotaBytes,
+// restoring usage saved by a previous run.
+func initQuotas() {
+	saved := make(map[string]*backendQuota)
+	if cfg.Frontend.FrontendQuotaStateFile != "" {
+		file, err := os.ReadFile(cfg.Frontend.FrontendQuotaStateFile)
+		if err == nil {
+			err = json.Unmarshal(file, &saved)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[QUOTA] Ignoring state file %v: %v", cfg.Frontend.FrontendQuotaStateFile, err)
+		}
+	}
+
+	now := time.Now()
+	for _, elem := range cfg.Backend {
+		if elem.BackendQuotaBytes <= 0 {
+			continue
+		}
+
+		q := &backendQuota{Limit: elem.BackendQuotaBytes}
+		if elem.BackendQuotaResetCron != "" {
+			schedule, err := parseCron(elem.BackendQuotaResetCron)
+			if err != nil {
+				log.Fatal("Config Quota Error: ", err)
+			}
+			q.schedule = schedule
+			q.NextReset = schedule.next(now)
+		}
+
+		if prev, ok := saved[elem.BackendName]; ok && (prev.NextReset.IsZero() || now.Before(prev.NextReset)) {
+			q.Used = prev.Used
+			if !prev.NextReset.IsZero() {
+				q.NextReset = prev.NextReset
+			}
+		}
+
+		quotas[elem.BackendName] = q
+	}
+
+	if len(quotas) > 0 {
+		go maintainQuotas()
+	}
+}
+
+// maintainQuotas resets quotas when their schedule fires and persists usage.
+func maintainQuotas() {
+	for range time.Tick(quotaCheckInterval) {
+		now := time.Now()
+
+		quotasMu.Lock()
+		for name, q := range quotas {
+			if q.schedule != nil && !q.NextReset.IsZero() && !now.Before(q.NextReset) {
+				log.Printf("[QUOTA] Resetting quota of %v after %v bytes", name, q.Used)
+				q.Used = 0
+				q.NextReset = q.schedule.next(now)
+			}
+		}
+		quotasMu.Unlock()
+
+		saveQuotas()
+	}
+}
+
+// saveQuotas writes quota usage to Frontend.QuotaStateFile.
+func saveQuotas() {
+	if cfg.Frontend.FrontendQuotaStateFile == "" {
+		return
+	}
+
+	quotasMu.Lock()
+	data, err := json.Marshal(quotas)
+	quotasMu.Unlock()
+	if err != nil {
+		log.Printf("[QUOTA] Saving state failed: %v", err)
+		return
+	}
+
+	tmp := cfg.Frontend.FrontendQuotaStateFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, cfg.Frontend.FrontendQuotaStateFile)
+	}
+	if err != nil {
+		log.Printf("[QUOTA] Saving state failed: %v", err)
+	}
+}
+
+func addQuotaUsage(backendName string, n int64) {
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+
+	if q, ok := quotas[backendName]; ok {
+		q.Used += n
+	}
+}
+
+// quotaExhausted reports whether the backend has used up its byte quota.
+func quotaExhausted(backendName string) bool {
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+
+	q, ok := quotas[backendName]
+	return ok && q.Used >= q.Limit
+}
+
+// writeQuotas renders remaining quota and time to reset per backend.
+func writeQuotas(w io.Writer) {
+	backends := backendsSnapshot()
+
+	var buf bytes.Buffer
+	quotasMu.Lock()
+	for _, elem := range backends {
+		q, ok := quotas[elem.BackendName]
+		if !ok {
+			continue
+		}
+
+		remaining := q.Limit - q.Used
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		reset := "never"
+		if !q.NextReset.IsZero() {
+			reset = time.Until(q.NextReset).Round(time.Second).String()
+		}
+		fmt.Fprintf(&buf, "%v - quota %v / %v bytes remaining, resets in %v\n", elem.BackendName, remaining, q.Limit, reset)
+	}
+	quotasMu.Unlock()
+
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimitDelay is the longest a command is held back by a rate limiter
+// before it is refused instead.
+const maxRateLimitDelay = 2 * time.Second
+
+// tokenBucket is a token bucket limiter refilled at rate tokens per second
+// up to burst tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait until
+// it is valid. If that wait would exceed maxWait no token is taken and ok
+// is false.
+func (b *tokenBucket) reserve(maxWait time.Duration) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+var (
+	userLimiters   = make(map[string]*tokenBucket)
+	userLimitersMu sync.Mutex
+
+	// userCommands counts the commands in flight per user across all of
+	// the user's sessions. Guarded by userLimitersMu.
+	userCommands = make(map[string]int)
+)
+
+// userCommandLimiter returns the limiter shared by all sessions of user, or
+// nil if the user's commands are not limited. The burst defaults to one
+// second worth of commands.
+func userCommandLimiter(user string, commandsPerSec float64, burst float64) *tokenBucket {
+	if commandsPerSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = commandsPerSec
+	}
+	// Clamped as newTokenBucket does, so an unchanged limit keeps the
+	// existing bucket.
+	if burst < 1 {
+		burst = 1
+	}
+
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	b, ok := userLimiters[user]
+	if !ok || b.rate != commandsPerSec || b.burst != burst {
+		b = newTokenBucket(commandsPerSec, burst)
+		userLimiters[user] = b
+	}
+	return b
+}
+
+// dropUserCommandLimiter forgets the limiter of a user without sessions.
+func dropUserCommandLimiter(user string) {
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+	delete(userLimiters, user)
+}
+
+// acquireUserCommand reserves one of the user's concurrent command slots. It
+// returns false if the user already has limit commands in flight; a zero
+// limit allows any number.
+func acquireUserCommand(user string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	if userCommands[user] >= limit {
+		return false
+	}
+	userCommands[user]++
+	return true
+}
+
+func releaseUserCommand(user string, limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	userLimitersMu.Lock()
+	defer userLimitersMu.Unlock()
+
+	userCommands[user]--
+}
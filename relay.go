@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// multilineCodes lists the response codes that are followed by a
+// dot-terminated data block.
+var multilineCodes = map[int]bool{
+	100: true, // HELP
+	101: true, // CAPABILITIES
+	215: true, // LIST
+	220: true, // ARTICLE
+	221: true, // HEAD / XHDR / XPAT
+	222: true, // BODY
+	224: true, // OVER / XOVER
+	225: true, // HDR
+	230: true, // NEWNEWS
+	231: true, // NEWGROUPS
+	282: true, // XGTITLE
+}
+
+// responseCode parses the three digit status code of a response line.
+func responseCode(line string) int {
+	if len(line) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// translateResponse rewrites the status code of a backend response line
+// according to the first matching mapping. The response text is kept.
+func translateResponse(mappings []config.ResponseMapping, line string) string {
+	code := responseCode(line)
+	if code == 0 {
+		return line
+	}
+	for _, elem := range mappings {
+		if elem.MappingFrom != code {
+			continue
+		}
+		if elem.MappingMatch != "" && !strings.Contains(strings.ToLower(line[3:]), strings.ToLower(elem.MappingMatch)) {
+			continue
+		}
+		return fmt.Sprintf("%d%s", elem.MappingTo, line[3:])
+	}
+	return line
+}
+
+// isMultilineResponse reports whether the status line sent in response to
+// verb announces a multi-line data block.
+func isMultilineResponse(verb string, line string) bool {
+	code := responseCode(line)
+	// 211 is followed by the article numbers only in response to LISTGROUP.
+	if code == 211 {
+		return verb == "LISTGROUP"
+	}
+	return multilineCodes[code]
+}
+
+// copyDataBlock copies a dot-terminated data block from src to dst verbatim,
+// including the terminating line. Dot-stuffing is preserved. If filter is
+// set it is called with every line before the terminator (the first buffer
+// full for very long lines); lines it returns false for are dropped.
+func copyDataBlock(dst io.Writer, src *bufio.Reader, filter func(line []byte) bool) (int64, error) {
+	var written int64
+	lineStart, keep := true, true
+
+	for {
+		chunk, err := src.ReadSlice('\n')
+
+		if lineStart && err == nil && (bytes.Equal(chunk, []byte(".\r\n")) || bytes.Equal(chunk, []byte(".\n"))) {
+			n, werr := dst.Write(chunk)
+			return written + int64(n), werr
+		}
+		if lineStart {
+			keep = filter == nil || filter(chunk)
+		}
+
+		if keep && len(chunk) > 0 {
+			n, werr := dst.Write(chunk)
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			lineStart = false
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		lineStart = true
+	}
+}
+
+// copyCompressedDataBlock decompresses a data block sent after
+// XFEATURE COMPRESS GZIP TERMINATOR and copies the plain dot-terminated block
+// to dst. The compressed stream is read to its end and the trailing
+// terminator line consumed, so src is positioned at the next response.
+func copyCompressedDataBlock(dst io.Writer, src *bufio.Reader, filter func(line []byte) bool) (int64, error) {
+	magic, err := src.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+
+	var zr io.ReadCloser
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(src)
+		if err != nil {
+			return 0, err
+		}
+		gz.Multistream(false)
+		zr = gz
+	} else {
+		zr, err = zlib.NewReader(src)
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer zr.Close()
+
+	written, err := copyDataBlock(dst, bufio.NewReader(zr), filter)
+	if err != nil {
+		return written, err
+	}
+
+	// Drain the stream trailer (checksum) before reading the terminator.
+	_, err = io.Copy(io.Discard, zr)
+	if err != nil {
+		return written, err
+	}
+
+	_, err = src.ReadSlice('\n')
+	return written, err
+}
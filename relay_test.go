@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestIsMultilineResponse(t *testing.T) {
+	tests := []struct {
+		verb string
+		line string
+		want bool
+	}{
+		{"HELP", "100 help text follows", true},
+		{"CAPABILITIES", "101 Capability list:", true},
+		{"LISTGROUP", "211 3 1 3 alt.test list follows", true},
+		{"GROUP", "211 3 1 3 alt.test", false},
+		{"LIST", "215 list of newsgroups follows", true},
+		{"ARTICLE", "220 1 <a@b> article", true},
+		{"HEAD", "221 1 <a@b> head", true},
+		{"XHDR", "221 Subject fields follow", true},
+		{"XPAT", "221 Header follows", true},
+		{"BODY", "222 1 <a@b> body", true},
+		{"OVER", "224 Overview information follows", true},
+		{"XOVER", "224 Overview information follows", true},
+		{"HDR", "225 Headers follow", true},
+		{"NEWNEWS", "230 list of new articles follows", true},
+		{"NEWGROUPS", "231 list of new newsgroups follows", true},
+		{"XGTITLE", "282 list follows", true},
+		{"MODE", "200 Reader mode, posting permitted", false},
+		{"DATE", "111 20260101000000", false},
+		{"STAT", "223 1 <a@b>", false},
+		{"POST", "340 Input article", false},
+		{"POST", "240 Article received OK", false},
+		{"GROUP", "411 No such newsgroup", false},
+		{"ARTICLE", "430 No such article", false},
+		{"XHDR", "412 No newsgroup selected", false},
+		{"LIST", "503 program fault", false},
+		{"ARTICLE", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := isMultilineResponse(tt.verb, tt.line); got != tt.want {
+			t.Errorf("isMultilineResponse(%q, %q) = %v, want %v", tt.verb, tt.line, got, tt.want)
+		}
+	}
+}
+
+// bufferConn is a client connection whose output is collected in a buffer.
+type bufferConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (bufferConn) Close() error { return nil }
+
+func TestRelayCommandXHDR(t *testing.T) {
+	const block = "221 Subject fields follow\r\n1 first\r\n2 ..second\r\n.\r\n"
+
+	proxySide, backendSide := net.Pipe()
+	defer proxySide.Close()
+	defer backendSide.Close()
+
+	commands := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(backendSide).ReadString('\n')
+		commands <- line
+		// The next response must not be relayed as part of the block.
+		backendSide.Write([]byte(block + "200 next\r\n"))
+	}()
+
+	var clientOut bytes.Buffer
+	s := &session{
+		backendConnection: proxySide,
+		backend:           textproto.NewConn(proxySide),
+		client:            textproto.NewConn(bufferConn{strings.NewReader(""), &clientOut}),
+		selectedBackend:   &config.SelectedBackend{BackendName: "test"},
+		command:           "XHDR Subject 1-2",
+	}
+
+	line, err := s.relayCommand("XHDR")
+	if err != nil {
+		t.Fatalf("relayCommand() error = %v", err)
+	}
+	if line != "221 Subject fields follow" {
+		t.Errorf("relayCommand() = %q, want the 221 status line", line)
+	}
+	if got := <-commands; got != "XHDR Subject 1-2\r\n" {
+		t.Errorf("backend got %q, want the XHDR command", got)
+	}
+	if clientOut.String() != block {
+		t.Errorf("client got %q, want %q", clientOut.String(), block)
+	}
+
+	next, err := s.backend.ReadLine()
+	if err != nil || next != "200 next" {
+		t.Errorf("after the block the backend reader is at %q, %v, want \"200 next\"", next, err)
+	}
+}
+
+// benchmarkArticle builds an article shaped like a yEnc encoded binary
+// posting of about size bytes, with 128 character data lines, dot-stuffed
+// where they start with a dot.
+func benchmarkArticle(size int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("Path: news.example.com!not-for-mail\r\n")
+	buf.WriteString("From: poster <poster@example.com>\r\n")
+	buf.WriteString("Newsgroups: alt.binaries.test\r\n")
+	buf.WriteString("Subject: [1/1] \"file.bin\" yEnc (1/1)\r\n")
+	buf.WriteString("Message-ID: <part1of1@example.com>\r\n")
+	buf.WriteString("\r\n=ybegin part=1 line=128 size=4194304 name=file.bin\r\n")
+
+	line := make([]byte, 128)
+	for i := 0; buf.Len() < size; i++ {
+		for j := range line {
+			line[j] = byte(42 + (i*131+j*7)%200)
+			if line[j] == '\r' || line[j] == '\n' || line[j] == 0 {
+				line[j] = 'x'
+			}
+		}
+		if line[0] == '.' {
+			buf.WriteByte('.')
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("=yend size=4194304 part=1 pcrc32=00000000\r\n.\r\n")
+	return buf.Bytes()
+}
+
+func BenchmarkCopyDataBlock(b *testing.B) {
+	article := benchmarkArticle(4 << 20)
+	b.SetBytes(int64(len(article)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := copyDataBlock(io.Discard, bufio.NewReader(bytes.NewReader(article)), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchUserReloadSignal reloads the user list whenever SIGUSR2 is received.
+func watchUserReloadSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	go func() {
+		for range sigs {
+			reloadUsers()
+		}
+	}()
+}
+
+// watchAuditReopenSignal reopens the audit log whenever SIGUSR1 is received.
+func watchAuditReopenSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+
+	go func() {
+		for range sigs {
+			reopenAuditLog()
+		}
+	}()
+}
+
+// watchCredentialReloadSignal reloads the backend credentials and the
+// message of the day whenever SIGHUP is received.
+func watchCredentialReloadSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	go func() {
+		for range sigs {
+			reloadBackendCredentials()
+			reloadMOTD()
+		}
+	}()
+}
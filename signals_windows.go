@@ -0,0 +1,18 @@
+package main
+
+import "log"
+
+// watchUserReloadSignal is a no-op on Windows, which has no SIGUSR2.
+func watchUserReloadSignal() {
+	log.Printf("[USERS] SIGUSR2 user reload is not supported on Windows")
+}
+
+// watchAuditReopenSignal is a no-op on Windows, which has no SIGUSR1.
+func watchAuditReopenSignal() {
+	log.Printf("[AUDIT] SIGUSR1 audit log reopen is not supported on Windows")
+}
+
+// watchCredentialReloadSignal is a no-op on Windows, which has no SIGHUP.
+func watchCredentialReloadSignal() {
+	log.Printf("[CREDENTIALS] SIGHUP credential and message of the day reload is not supported on Windows")
+}
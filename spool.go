@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// With FrontendSpoolDir, successful ARTICLE and BODY responses by message-id
+// are copied to the spool while they are relayed, and later requests for
+// the same article are answered from disk without asking a backend. Each
+// file holds the backend status line and the data block as relayed. Writing
+// happens in the background after the response has been sent, and articles
+// that cannot be spooled are simply skipped. FrontendMaxBufferedResponseBytes
+// caps the memory all sessions may use for responses being collected or
+// queued for writing; responses that do not fit are relayed without being
+// spooled.
+
+const (
+	defaultSpoolMaxBytes        = 1 << 30
+	defaultSpoolMaxArticleBytes = 10 << 20
+	spoolQueueSize              = 64
+)
+
+type spoolEntry struct {
+	name string
+	size int64
+}
+
+// articleSpool indexes the spool files, evicting the least recently used
+// ones once the spool exceeds its size limit.
+type articleSpool struct {
+	mu      sync.Mutex
+	dir     string
+	max     int64
+	total   int64
+	order   *list.List
+	entries map[string]*list.Element
+	queue   chan spoolItem
+}
+
+type spoolItem struct {
+	name string
+	data []byte
+}
+
+var (
+	// spool is nil unless FrontendSpoolDir is set.
+	spool *articleSpool
+
+	// bufferedBytes is the memory held by spool buffers and queued spool
+	// writes across all sessions.
+	bufferedBytes atomic.Int64
+)
+
+// initSpool indexes the files left in the spool directory by a previous run
+// and starts the spool writer.
+func initSpool() {
+	if cfg.Frontend.FrontendSpoolDir == "" {
+		return
+	}
+
+	err := os.MkdirAll(cfg.Frontend.FrontendSpoolDir, 0700)
+	if err != nil {
+		log.Fatal("Config Spool Error: ", err)
+	}
+
+	max := cfg.Frontend.FrontendSpoolMaxBytes
+	if max <= 0 {
+		max = defaultSpoolMaxBytes
+	}
+	spool = &articleSpool{
+		dir:     cfg.Frontend.FrontendSpoolDir,
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		queue:   make(chan spoolItem, spoolQueueSize),
+	}
+
+	files, err := os.ReadDir(spool.dir)
+	if err != nil {
+		log.Fatal("Config Spool Error: ", err)
+	}
+	infos := []os.FileInfo{}
+	for _, elem := range files {
+		info, err := elem.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			os.Remove(filepath.Join(spool.dir, info.Name()))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	// Oldest first, so the most recent files end up at the front.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, elem := range infos {
+		spool.add(elem.Name(), elem.Size())
+	}
+
+	log.Printf("[SPOOL] %v articles, %v bytes in %v", spool.order.Len(), spool.total, spool.dir)
+	go spool.writeQueued()
+}
+
+// spoolName returns the spool file name for the command, or "" if its
+// response is not spooled.
+func spoolName(verb string, command string) string {
+	if spool == nil || (verb != "ARTICLE" && verb != "BODY") || !isPoolableCommand(verb, command) {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(verb + " " + strings.Fields(command)[1]))
+	return hex.EncodeToString(sum[:])
+}
+
+// add records a file in the index and evicts old files beyond the size
+// limit.
+func (sp *articleSpool) add(name string, size int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if e, ok := sp.entries[name]; ok {
+		sp.total -= e.Value.(*spoolEntry).size
+		sp.order.Remove(e)
+	}
+	sp.entries[name] = sp.order.PushFront(&spoolEntry{name, size})
+	sp.total += size
+
+	for sp.total > sp.max && sp.order.Len() > 1 {
+		oldest := sp.order.Back()
+		entry := oldest.Value.(*spoolEntry)
+		sp.order.Remove(oldest)
+		delete(sp.entries, entry.name)
+		sp.total -= entry.size
+		os.Remove(filepath.Join(sp.dir, entry.name))
+	}
+}
+
+// open returns the spooled response of name, if there is one.
+func (sp *articleSpool) open(name string) (*os.File, bool) {
+	sp.mu.Lock()
+	e, ok := sp.entries[name]
+	if ok {
+		sp.order.MoveToFront(e)
+	}
+	sp.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	file, err := os.Open(filepath.Join(sp.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	return file, true
+}
+
+// store queues a response for writing, dropping it if the writer is behind.
+func (sp *articleSpool) store(name string, data []byte) {
+	select {
+	case sp.queue <- spoolItem{name, data}:
+	default:
+		debugf("Spool queue full, skipping %v", name)
+		releaseBuffered(len(data))
+	}
+}
+
+// writeQueued writes queued responses to the spool directory.
+func (sp *articleSpool) writeQueued() {
+	for item := range sp.queue {
+		path := filepath.Join(sp.dir, item.name)
+		err := os.WriteFile(path+".tmp", item.data, 0600)
+		releaseBuffered(len(item.data))
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			log.Printf("[SPOOL] Writing %v failed: %v", item.name, err)
+			os.Remove(path + ".tmp")
+			continue
+		}
+		sp.add(item.name, int64(len(item.data)))
+	}
+}
+
+// spoolBuffer collects a response while it is relayed. It never fails, so
+// the relay to the client is not affected; responses larger than the limit
+// are dropped.
+type spoolBuffer struct {
+	data     []byte
+	limit    int
+	overflow bool
+}
+
+func newSpoolBuffer(line string) *spoolBuffer {
+	limit := int(cfg.Frontend.FrontendSpoolMaxArticleBytes)
+	if limit <= 0 {
+		limit = defaultSpoolMaxArticleBytes
+	}
+	b := &spoolBuffer{limit: limit}
+	b.Write([]byte(line + "\r\n"))
+	return b
+}
+
+func (b *spoolBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if len(b.data)+len(p) <= b.limit && reserveBuffered(len(p)) {
+		b.data = append(b.data, p...)
+	} else {
+		b.overflow = true
+		releaseBuffered(len(b.data))
+		b.data = nil
+	}
+	return len(p), nil
+}
+
+// finish hands the collected response to the spool if the relay succeeded
+// and it fit, and frees the buffer otherwise.
+func (b *spoolBuffer) finish(name string, ok bool) {
+	if ok && !b.overflow {
+		spool.store(name, b.data)
+		return
+	}
+	releaseBuffered(len(b.data))
+	b.data = nil
+}
+
+// reserveBuffered accounts n more bytes of buffered responses, reporting
+// false without accounting them if that would exceed
+// FrontendMaxBufferedResponseBytes.
+func reserveBuffered(n int) bool {
+	total := bufferedBytes.Add(int64(n))
+	if max := cfg.Frontend.FrontendMaxBufferedResponseBytes; max > 0 && total > max {
+		bufferedBytes.Add(-int64(n))
+		return false
+	}
+	return true
+}
+
+func releaseBuffered(n int) {
+	bufferedBytes.Add(-int64(n))
+}
+
+// serveSpooled answers the current command from the spool. A request by
+// article number gets that number in the status line. It returns false if
+// the article is not spooled, and the number of bytes sent otherwise.
+func (s *session) serveSpooled(name string, number string) (bool, int64, error) {
+	file, ok := spool.open(name)
+	if !ok {
+		return false, 0, nil
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return false, 0, nil
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if fields := strings.Fields(line); number != "" && len(fields) >= 3 {
+		fields[1] = number
+		line = strings.Join(fields, " ")
+	}
+
+	err = s.client.PrintfLine("%s", translateResponse(s.selectedBackend.BackendResponseMap, line))
+	if err != nil {
+		return true, 0, err
+	}
+	n, err := io.Copy(s.client.W, r)
+	if err != nil {
+		return true, n, err
+	}
+	return true, n + int64(len(line)+2), s.client.W.Flush()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type stateBackend struct {
+	Name                string     `json:"name"`
+	Connections         int        `json:"connections"`
+	MaxConnections      int        `json:"maxConnections"`
+	IdlePooled          int        `json:"idlePooled"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+	BytesProxied        int64      `json:"bytesProxied"`
+	QuotaBytes          int64      `json:"quotaBytes,omitempty"`
+	QuotaUsed           int64      `json:"quotaUsed,omitempty"`
+	AvgHoldSeconds      float64    `json:"avgHoldSeconds"`
+	MaxHoldSeconds      float64    `json:"maxHoldSeconds"`
+}
+
+type stateUser struct {
+	Name               string `json:"name"`
+	Connections        int    `json:"connections"`
+	MaxConnections     int    `json:"maxConnections"`
+	ReadConnections    int    `json:"readConnections"`
+	MaxReadConnections int    `json:"maxReadConnections,omitempty"`
+	PostConnections    int    `json:"postConnections"`
+	MaxPostConnections int    `json:"maxPostConnections,omitempty"`
+	BytesUsed          int64  `json:"bytesUsed"`
+	MaxBytes           int64  `json:"maxBytes,omitempty"`
+}
+
+type stateGroup struct {
+	Name           string `json:"name"`
+	Connections    int    `json:"connections"`
+	MaxConnections int    `json:"maxConnections"`
+}
+
+type stateSessions struct {
+	Active int64 `json:"active"`
+	Peak   int64 `json:"peak"`
+	Total  int64 `json:"total"`
+}
+
+type stateDocument struct {
+	Time         time.Time      `json:"time"`
+	Ready        bool           `json:"ready"`
+	Maintenance  bool           `json:"maintenance"`
+	Window       string         `json:"maintenanceWindow,omitempty"`
+	Backends     []stateBackend `json:"backends"`
+	Users        []stateUser    `json:"users"`
+	Groups       []stateGroup   `json:"connectionGroups"`
+	Sessions     stateSessions  `json:"sessions"`
+	AuthFailures int64          `json:"authFailures"`
+}
+
+// stateHandler returns the runtime state as one JSON document. Counts are
+// read under mu, so backends and users are consistent with each other.
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	state := stateDocument{
+		Time:        time.Now(),
+		Ready:       ready.Load(),
+		Maintenance: inMaintenance(),
+		Window:      activeMaintenanceWindow(),
+		Backends:    []stateBackend{},
+		Users:       []stateUser{},
+		Groups:      []stateGroup{},
+	}
+
+	mu.Lock()
+	quotasMu.Lock()
+	for _, elem := range cfg.Backend {
+		b := stateBackend{
+			Name:                elem.BackendName,
+			Connections:         backendConnections[elem.BackendName],
+			MaxConnections:      elem.BackendConns,
+			IdlePooled:          len(idleConns[elem.BackendName]),
+			Healthy:             !backendUnhealthy[elem.BackendName],
+			ConsecutiveFailures: backendFailures[elem.BackendName],
+		}
+		if last, ok := backendLastFailure[elem.BackendName]; ok {
+			b.LastFailure = &last
+		}
+		if counter, ok := backendBytes.Load(elem.BackendName); ok {
+			b.BytesProxied = counter.(*atomic.Int64).Load()
+		}
+		if h, ok := backendHolds[elem.BackendName]; ok {
+			b.AvgHoldSeconds = h.average().Seconds()
+			b.MaxHoldSeconds = h.max.Seconds()
+		}
+		if q, ok := quotas[elem.BackendName]; ok {
+			b.QuotaBytes = q.Limit
+			b.QuotaUsed = q.Used
+		}
+		state.Backends = append(state.Backends, b)
+	}
+
+	for _, elem := range cfg.Users {
+		state.Users = append(state.Users, stateUser{
+			Name:               elem.Username,
+			Connections:        userConnections[elem.Username],
+			MaxConnections:     cfg.UserMaxConnections(elem),
+			ReadConnections:    readConnectionsLocked(elem.Username),
+			MaxReadConnections: elem.MaxReadConnections,
+			PostConnections:    postConnections[elem.Username],
+			MaxPostConnections: elem.MaxPostConnections,
+			BytesUsed:          userBytes[elem.Username],
+			MaxBytes:           elem.MaxBytes,
+		})
+	}
+	quotasMu.Unlock()
+
+	for _, elem := range cfg.ConnectionGroups {
+		state.Groups = append(state.Groups, stateGroup{elem.GroupName, groupConnections[elem.GroupName], elem.GroupMaxConnections})
+	}
+	mu.Unlock()
+
+	state.Sessions = stateSessions{
+		Active: activeSessions.Load(),
+		Peak:   peakSessions.Load(),
+		Total:  totalSessions.Load(),
+	}
+	state.AuthFailures = authFailures.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(state)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rexjohannes/nntp-proxy-2/config"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Process lifetime counters, reported on shutdown.
+var (
+	totalSessions   atomic.Int64
+	activeSessions  atomic.Int64
+	peakSessions    atomic.Int64
+	authFailures    atomic.Int64
+	backendBytes    sync.Map // backend name -> *atomic.Int64
+	credentialBytes sync.Map // credentialKey -> *atomic.Int64
+)
+
+// Connections closed without authenticating since the last summary, and how
+// many of them were not logged because of sampling.
+var (
+	unauthenticatedSessions   atomic.Int64
+	unauthenticatedSuppressed atomic.Int64
+)
+
+const unauthenticatedSummaryInterval = time.Minute
+
+// holdStats accumulates how long sessions held a slot of a backend.
+type holdStats struct {
+	count int64
+	total time.Duration
+	max   time.Duration
+}
+
+func (h *holdStats) average() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.total / time.Duration(h.count)
+}
+
+// backendHolds holds the slot hold times per backend. Guarded by mu.
+var backendHolds = make(map[string]*holdStats)
+
+// recordHoldLocked adds a finished slot hold of the backend. Must be called
+// with mu held.
+func recordHoldLocked(backendName string, d time.Duration) {
+	h, ok := backendHolds[backendName]
+	if !ok {
+		h = &holdStats{}
+		backendHolds[backendName] = h
+	}
+	h.count++
+	h.total += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// writeBackendHolds renders the average and longest slot hold per backend.
+func writeBackendHolds(w io.Writer) {
+	var buf bytes.Buffer
+	mu.Lock()
+	for _, elem := range cfg.Backend {
+		h, ok := backendHolds[elem.BackendName]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, "%v - hold avg %v / max %v (%v sessions)\n", elem.BackendName, h.average().Round(time.Second), h.max.Round(time.Second), h.count)
+	}
+	mu.Unlock()
+
+	w.Write(buf.Bytes())
+}
+
+// maxRecentAuthFailures bounds the auth failures kept for the dashboard.
+const maxRecentAuthFailures = 20
+
+type authFailure struct {
+	Time     time.Time
+	Username string
+	IP       string
+}
+
+var (
+	recentAuthFailures   []authFailure
+	recentAuthFailuresMu sync.Mutex
+)
+
+func recordAuthFailure(username string, ip string) {
+	authFailures.Add(1)
+
+	recentAuthFailuresMu.Lock()
+	defer recentAuthFailuresMu.Unlock()
+
+	recentAuthFailures = append(recentAuthFailures, authFailure{time.Now(), username, ip})
+	if len(recentAuthFailures) > maxRecentAuthFailures {
+		recentAuthFailures = recentAuthFailures[1:]
+	}
+}
+
+// sessionStarted counts a new client session. It returns false without
+// counting it if FrontendMaxConnections sessions are already active.
+func sessionStarted() bool {
+	active := activeSessions.Add(1)
+	if limit := cfg.Frontend.FrontendMaxConnections; limit > 0 && active > int64(limit) {
+		activeSessions.Add(-1)
+		return false
+	}
+	totalSessions.Add(1)
+	for {
+		peak := peakSessions.Load()
+		if active <= peak || peakSessions.CompareAndSwap(peak, active) {
+			return true
+		}
+	}
+}
+
+func sessionEnded() {
+	activeSessions.Add(-1)
+}
+
+// sampleConnectionLog decides whether the pre-authentication logs of a new
+// connection are written. Without FrontendLogSampleRate every connection is
+// logged.
+func sampleConnectionLog() bool {
+	rate := cfg.Frontend.FrontendLogSampleRate
+	return rate <= 0 || rand.Float64() < rate
+}
+
+func unauthenticatedEnded(logged bool) {
+	unauthenticatedSessions.Add(1)
+	if !logged {
+		unauthenticatedSuppressed.Add(1)
+	}
+}
+
+// logUnauthenticatedSummary periodically logs how many connections closed
+// without authenticating, so sampled-out connections are still accounted.
+func logUnauthenticatedSummary() {
+	for range time.Tick(unauthenticatedSummaryInterval) {
+		n := unauthenticatedSessions.Swap(0)
+		suppressed := unauthenticatedSuppressed.Swap(0)
+		if n > 0 {
+			log.Printf("[CONN] %v connections closed without authenticating in the last %v (%v not logged)", n, unauthenticatedSummaryInterval, suppressed)
+		}
+	}
+}
+
+func addCounter(counters *sync.Map, key string, n int64) {
+	counter, ok := counters.Load(key)
+	if !ok {
+		counter, _ = counters.LoadOrStore(key, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(n)
+}
+
+func addBackendBytes(selectedBackend *config.SelectedBackend, n int64) {
+	addCounter(&backendBytes, selectedBackend.BackendName, n)
+	addQuotaUsage(selectedBackend.BackendName, n)
+	addCounter(&credentialBytes, credentialKey(selectedBackend.BackendName, selectedBackend.BackendUser), n)
+}
+
+// logSummary logs the counters accumulated since start.
+func logSummary() {
+	log.Printf("[SUMMARY] Sessions served: %v", totalSessions.Load())
+	log.Printf("[SUMMARY] Peak concurrent connections: %v", peakSessions.Load())
+	log.Printf("[SUMMARY] Authentication failures: %v", authFailures.Load())
+	for _, elem := range backendsSnapshot() {
+		var n int64
+		if counter, ok := backendBytes.Load(elem.BackendName); ok {
+			n = counter.(*atomic.Int64).Load()
+		}
+		log.Printf("[SUMMARY] Bytes proxied via %v: %v", elem.BackendName, n)
+	}
+}
+
+// maxSessionGroups bounds the distinct groups remembered per session.
+const maxSessionGroups = 256
+
+// sessionMetrics accumulates the per-session figures logged at teardown.
+// Only the session's own goroutine updates them.
+type sessionMetrics struct {
+	start         time.Time
+	commands      int64
+	latency       time.Duration
+	bytesIn       int64
+	bytesOut      int64
+	fetches       int
+	peakFetches   int
+	groups        map[string]bool
+	groupOverflow bool
+	groupSwitches int
+}
+
+func (m *sessionMetrics) observeCommand(d time.Duration) {
+	m.commands++
+	m.latency += d
+}
+
+func (m *sessionMetrics) fetchStarted() {
+	m.fetches++
+	if m.fetches > m.peakFetches {
+		m.peakFetches = m.fetches
+	}
+}
+
+func (m *sessionMetrics) fetchEnded() {
+	m.fetches--
+}
+
+func (m *sessionMetrics) addGroup(group string) {
+	if m.groups == nil {
+		m.groups = make(map[string]bool)
+	}
+	if len(m.groups) >= maxSessionGroups && !m.groups[group] {
+		m.groupOverflow = true
+		return
+	}
+	m.groups[group] = true
+}
+
+func (m *sessionMetrics) String() string {
+	var avg time.Duration
+	if m.commands > 0 {
+		avg = m.latency / time.Duration(m.commands)
+	}
+	groups := fmt.Sprint(len(m.groups))
+	if m.groupOverflow {
+		groups += "+"
+	}
+	return fmt.Sprintf("duration %v, %v commands, avg latency %v, peak fetches %v, %v bytes in, %v bytes out, %v groups, %v group switches",
+		time.Since(m.start).Round(time.Second), m.commands, avg.Round(time.Microsecond), m.peakFetches, m.bytesIn, m.bytesOut, groups, m.groupSwitches)
+}
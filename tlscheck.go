@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkFrontendCertificate validates the frontend certificate at startup and
+// logs its expiry. The key pair itself is already checked when loading. With
+// FrontendTLSStrictStartup a problem stops the proxy, otherwise it is logged.
+func checkFrontendCertificate(cer tls.Certificate) {
+	err := verifyFrontendCertificate(cer)
+	if err == nil {
+		return
+	}
+	if cfg.Frontend.FrontendTLSStrictStartup {
+		log.Fatal("TLS Certificate Error: ", err)
+	}
+	log.Printf("[WARN] TLS certificate: %v", err)
+}
+
+func verifyFrontendCertificate(cer tls.Certificate) error {
+	if len(cer.Certificate) == 0 {
+		return errors.New("no certificate loaded")
+	}
+
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	days := int(leaf.NotAfter.Sub(now).Hours() / 24)
+	log.Printf("[TLS] Certificate %v expires %v (%v days remaining)", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02"), days)
+
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %v", leaf.NotAfter.Format("2006-01-02"))
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid before %v", leaf.NotBefore.Format("2006-01-02"))
+	}
+
+	if cfg.Frontend.FrontendTLSCABundle == "" {
+		return nil
+	}
+
+	bundle, err := os.ReadFile(cfg.Frontend.FrontendTLSCABundle)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificates found in %v", cfg.Frontend.FrontendTLSCABundle)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, elem := range cer.Certificate[1:] {
+		cert, err := x509.ParseCertificate(elem)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return fmt.Errorf("incomplete certificate chain: %v", err)
+	}
+	return nil
+}
+
+// errCertMismatch reports a backend certificate that does not match
+// BackendPinnedCertSHA256.
+var errCertMismatch = errors.New("backend certificate does not match pinned fingerprint")
+
+// verifyPinnedCert returns a VerifyPeerCertificate callback accepting only a
+// leaf certificate whose SHA-256 fingerprint is pin, given in hex with
+// optional colons. It runs with and without chain verification.
+func verifyPinnedCert(pin string) func([][]byte, [][]*x509.Certificate) error {
+	pin = strings.ReplaceAll(pin, ":", "")
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errCertMismatch
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), pin) {
+			return errCertMismatch
+		}
+		return nil
+	}
+}
+
+// checkPinnedCert validates the format of a BackendPinnedCertSHA256 value.
+func checkPinnedCert(pin string) error {
+	raw, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("%q is not a SHA-256 fingerprint in hex", pin)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// userQuotaState is the per-user byte usage saved to
+// FrontendUserQuotaStateFile.
+type userQuotaState struct {
+	Used      map[string]int64 `json:"used"`
+	NextReset time.Time        `json:"nextReset"`
+}
+
+var (
+	// userBytes holds the bytes relayed from backends to the clients of
+	// every user since the last reset. Guarded by quotasMu.
+	userBytes         = make(map[string]int64)
+	userQuotaReset    time.Time
+	userQuotaSchedule *cronSchedule
+)
+
+// initUserQuotas restores user byte usage saved by a previous run and starts
+// resetting and persisting it.
+func initUserQuotas() {
+	now := time.Now()
+	if cfg.Frontend.FrontendUserQuotaResetCron != "" {
+		schedule, err := parseCron(cfg.Frontend.FrontendUserQuotaResetCron)
+		if err != nil {
+			log.Fatal("Config User Quota Error: ", err)
+		}
+		userQuotaSchedule = schedule
+		userQuotaReset = schedule.next(now)
+	}
+
+	if cfg.Frontend.FrontendUserQuotaStateFile != "" {
+		var saved userQuotaState
+		file, err := os.ReadFile(cfg.Frontend.FrontendUserQuotaStateFile)
+		if err == nil {
+			err = json.Unmarshal(file, &saved)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[QUOTA] Ignoring user state file %v: %v", cfg.Frontend.FrontendUserQuotaStateFile, err)
+		}
+		if saved.Used != nil && (saved.NextReset.IsZero() || now.Before(saved.NextReset)) {
+			userBytes = saved.Used
+			if !saved.NextReset.IsZero() && userQuotaSchedule != nil {
+				userQuotaReset = saved.NextReset
+			}
+		}
+	}
+
+	if userQuotaSchedule != nil || cfg.Frontend.FrontendUserQuotaStateFile != "" {
+		go maintainUserQuotas()
+	}
+}
+
+// maintainUserQuotas resets user usage when the schedule fires and persists
+// it.
+func maintainUserQuotas() {
+	for range time.Tick(quotaCheckInterval) {
+		now := time.Now()
+
+		quotasMu.Lock()
+		if userQuotaSchedule != nil && !userQuotaReset.IsZero() && !now.Before(userQuotaReset) {
+			log.Printf("[QUOTA] Resetting user quotas")
+			userBytes = make(map[string]int64)
+			userQuotaReset = userQuotaSchedule.next(now)
+		}
+		quotasMu.Unlock()
+
+		saveUserQuotas()
+	}
+}
+
+// saveUserQuotas writes user usage to Frontend.UserQuotaStateFile.
+func saveUserQuotas() {
+	if cfg.Frontend.FrontendUserQuotaStateFile == "" {
+		return
+	}
+
+	quotasMu.Lock()
+	data, err := json.Marshal(userQuotaState{userBytes, userQuotaReset})
+	quotasMu.Unlock()
+	if err != nil {
+		log.Printf("[QUOTA] Saving user state failed: %v", err)
+		return
+	}
+
+	tmp := cfg.Frontend.FrontendUserQuotaStateFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, cfg.Frontend.FrontendUserQuotaStateFile)
+	}
+	if err != nil {
+		log.Printf("[QUOTA] Saving user state failed: %v", err)
+	}
+}
+
+func addUserBytes(user string, n int64) {
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+
+	userBytes[user] += n
+}
+
+// userQuotaExceeded reports whether the user has used up maxBytes. Users
+// without a limit never exceed it.
+func userQuotaExceeded(user string, maxBytes int64) bool {
+	if maxBytes <= 0 {
+		return false
+	}
+
+	quotasMu.Lock()
+	defer quotasMu.Unlock()
+	return userBytes[user] >= maxBytes
+}
+
+// writeUserQuotas renders the usage of every user with a byte limit.
+func writeUserQuotas(w io.Writer) {
+	mu.Lock()
+	users := cfg.Users
+	mu.Unlock()
+
+	var buf bytes.Buffer
+	quotasMu.Lock()
+	for _, elem := range users {
+		if elem.MaxBytes <= 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "user %v - quota %v / %v bytes used\n", elem.Username, userBytes[elem.Username], elem.MaxBytes)
+	}
+	quotasMu.Unlock()
+
+	w.Write(buf.Bytes())
+}